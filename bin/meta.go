@@ -1 +0,0 @@
-package bin; var Meta = []byte{0}
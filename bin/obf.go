@@ -1 +0,0 @@
-package bin; var Obf = []byte{0}
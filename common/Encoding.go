@@ -0,0 +1,177 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Binary metadata format
+//
+// The metadata of all modules is serialized into a compact binary format:
+//
+//	header:      magic "PTOM" | version (1 byte) | flags (1 byte) | module count
+//	module:      name | region count | regions | instruction count | instructions
+//	region:      name | addr | size
+//	instruction: addr delta | region | trap | length | semantic record (see EncodeSemantics)
+//
+// All numbers are unsigned varints and strings are prefixed with their length. The instructions
+// of a module are sorted by address and each address is stored as the difference to the previous one.
+// Version 1 stored the original instruction bytes instead of the semantic records, version 2 had no traps.
+const (
+	metadataVersion = 3
+	metadataFlags   = 0 // No flags are defined yet
+)
+
+var metadataMagic = []byte("PTOM")
+
+// ErrInvalidMetadata is returned, if binary metadata is malformed
+var ErrInvalidMetadata = errors.New("invalid metadata")
+
+// EncodeMetadata serializes the metadata of the binary and the libraries into the binary metadata format
+func EncodeMetadata(modules []ExportMetadata) []byte {
+	var buf bytes.Buffer
+	buf.Write(metadataMagic)
+	buf.WriteByte(metadataVersion)
+	buf.WriteByte(metadataFlags)
+	writeUvarint(&buf, uint64(len(modules)))
+
+	for _, m := range modules {
+		writeString(&buf, m.Name)
+		writeUvarint(&buf, uint64(len(m.Regions)))
+		for _, region := range m.Regions {
+			writeString(&buf, region.Name)
+			writeUvarint(&buf, region.Addr)
+			writeUvarint(&buf, region.Size)
+		}
+
+		instructions := make([]ExportObfuscatedInstruction, len(m.Instructions))
+		copy(instructions, m.Instructions)
+		sort.Slice(instructions, func(i, j int) bool {
+			return instructions[i].Addr < instructions[j].Addr
+		})
+		writeUvarint(&buf, uint64(len(instructions)))
+		prev := uint64(0)
+		for _, inst := range instructions {
+			writeUvarint(&buf, inst.Addr-prev)
+			writeUvarint(&buf, uint64(inst.Region))
+			buf.WriteByte(byte(inst.Trap))
+			writeUvarint(&buf, uint64(len(inst.Semantics)))
+			buf.Write(inst.Semantics)
+			prev = inst.Addr
+		}
+	}
+	return buf.Bytes()
+}
+
+// DecodeMetadata deserializes metadata in the binary metadata format
+func DecodeMetadata(data []byte) ([]ExportMetadata, error) {
+	r := bytes.NewReader(data)
+	header := make([]byte, len(metadataMagic)+2)
+	if _, err := r.Read(header); err != nil || !bytes.Equal(header[:len(metadataMagic)], metadataMagic) {
+		return nil, ErrInvalidMetadata
+	}
+	if version := header[len(metadataMagic)]; version != metadataVersion {
+		return nil, fmt.Errorf("unsupported metadata version %d", version)
+	}
+	if flags := header[len(metadataMagic)+1]; flags != metadataFlags {
+		return nil, fmt.Errorf("unsupported metadata flags %#x", flags)
+	}
+
+	count, err := readCount(r)
+	if err != nil {
+		return nil, err
+	}
+	modules := make([]ExportMetadata, count)
+	for i := range modules {
+		m := &modules[i]
+		if m.Name, err = readString(r); err != nil {
+			return nil, err
+		}
+
+		if count, err = readCount(r); err != nil {
+			return nil, err
+		}
+		m.Regions = make([]Region, count)
+		for j := range m.Regions {
+			if m.Regions[j].Name, err = readString(r); err != nil {
+				return nil, err
+			}
+			if m.Regions[j].Addr, err = binary.ReadUvarint(r); err != nil {
+				return nil, ErrInvalidMetadata
+			}
+			if m.Regions[j].Size, err = binary.ReadUvarint(r); err != nil {
+				return nil, ErrInvalidMetadata
+			}
+		}
+
+		if count, err = readCount(r); err != nil {
+			return nil, err
+		}
+		m.Instructions = make([]ExportObfuscatedInstruction, count)
+		addr := uint64(0)
+		for j := range m.Instructions {
+			delta, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, ErrInvalidMetadata
+			}
+			region, err := binary.ReadUvarint(r)
+			if err != nil || region >= uint64(len(m.Regions)) {
+				return nil, ErrInvalidMetadata
+			}
+			trap, err := r.ReadByte()
+			if err != nil || int(trap) >= len(trapCodes) {
+				return nil, ErrInvalidMetadata
+			}
+			semantics, err := readBytes(r)
+			if err != nil {
+				return nil, err
+			}
+			addr += delta
+			m.Instructions[j] = ExportObfuscatedInstruction{Semantics: semantics, Addr: addr, Region: uint16(region), Trap: Trap(trap)}
+		}
+	}
+
+	if r.Len() != 0 {
+		return nil, ErrInvalidMetadata
+	}
+	return modules, nil
+}
+
+func writeUvarint(buf *bytes.Buffer, x uint64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutUvarint(b[:], x)])
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	writeUvarint(buf, uint64(len(s)))
+	buf.WriteString(s)
+}
+
+// Read a length or count, which can't exceed the remaining data
+func readCount(r *bytes.Reader) (int, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil || n > uint64(r.Len()) {
+		return 0, ErrInvalidMetadata
+	}
+	return int(n), nil
+}
+
+func readBytes(r *bytes.Reader) ([]byte, error) {
+	n, err := readCount(r)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	if _, err := r.Read(b); err != nil && n > 0 {
+		return nil, ErrInvalidMetadata
+	}
+	return b, nil
+}
+
+func readString(r *bytes.Reader) (string, error) {
+	b, err := readBytes(r)
+	return string(b), err
+}
@@ -0,0 +1,66 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+func testMetadata() []ExportMetadata {
+	return []ExportMetadata{
+		{
+			Name:    "binary",
+			Regions: []Region{{Name: ".text", Addr: 0x1000, Size: 0x2000}, {Name: ".plt", Addr: 0x3000, Size: 0x100}},
+			Instructions: []ExportObfuscatedInstruction{
+				{Semantics: EncodeSemantics(testSemantics[0]), Addr: 0x1010, Region: 0, Trap: TrapInt3},
+				{Semantics: EncodeSemantics(testSemantics[3]), Addr: 0x3008, Region: 1, Trap: TrapUD2},
+				{Semantics: EncodeSemantics(testSemantics[8]), Addr: 0x1ff0, Region: 0, Trap: TrapInvalid},
+			},
+		},
+		{
+			Name:         "libfoo.so.1",
+			Regions:      []Region{{Name: ".text", Addr: 0x500, Size: 0x80}},
+			Instructions: []ExportObfuscatedInstruction{},
+		},
+	}
+}
+
+func TestMetadataRoundTrip(t *testing.T) {
+	modules := testMetadata()
+	got, err := DecodeMetadata(EncodeMetadata(modules))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The instructions are sorted by address
+	want := testMetadata()
+	want[0].Instructions[1], want[0].Instructions[2] = want[0].Instructions[2], want[0].Instructions[1]
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decoded as %+v, want %+v", got, want)
+	}
+	if !reflect.DeepEqual(modules, testMetadata()) {
+		t.Errorf("encoding modified the metadata")
+	}
+}
+
+func TestDecodeMetadataInvalid(t *testing.T) {
+	valid := EncodeMetadata(testMetadata())
+	modify := func(i int, b byte) []byte {
+		data := append([]byte(nil), valid...)
+		data[i] = b
+		return data
+	}
+	tests := map[string][]byte{
+		"empty":         {},
+		"magic":         modify(0, 'X'),
+		"version":       modify(len(metadataMagic), metadataVersion+1),
+		"flags":         modify(len(metadataMagic)+1, 1),
+		"module count":  modify(len(metadataMagic)+2, 0x7f),
+		"truncated":     valid[:len(valid)-1],
+		"trailing data": append(append([]byte(nil), valid...), 0),
+	}
+	for name, data := range tests {
+		if modules, err := DecodeMetadata(data); err == nil {
+			t.Errorf("%s: decoded as %+v", name, modules)
+		}
+	}
+}
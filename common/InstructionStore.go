@@ -0,0 +1,77 @@
+package common
+
+import (
+	"sort"
+)
+
+// InstructionStore holds the obfuscated instructions of a module sorted by address
+// The semantics are only decoded, when they are looked up for the first time. Most obfuscated
+// instructions of a large binary are never executed, so decoding all of them at startup is wasted time.
+// An InstructionStore isn't safe for concurrent use.
+type InstructionStore struct {
+	raw     []ExportObfuscatedInstruction
+	decoded []*Semantics // Cache of the decoded semantics, nil if not decoded yet
+}
+
+// NewInstructionStore creates a store from external metadata without decoding any semantics
+func NewInstructionStore(input []ExportObfuscatedInstruction) *InstructionStore {
+	raw := make([]ExportObfuscatedInstruction, len(input))
+	copy(raw, input)
+	if !sort.SliceIsSorted(raw, func(i, j int) bool { return raw[i].Addr < raw[j].Addr }) {
+		sort.Slice(raw, func(i, j int) bool { return raw[i].Addr < raw[j].Addr })
+	}
+	return &InstructionStore{raw: raw, decoded: make([]*Semantics, len(raw))}
+}
+
+// Instructions returns the raw instructions sorted by address
+func (s *InstructionStore) Instructions() []ExportObfuscatedInstruction {
+	return s.raw
+}
+
+// Lookup searches the instruction at addr and decodes its semantics, if necessary
+// Returns false, if there is no obfuscated instruction at addr.
+func (s *InstructionStore) Lookup(addr uint64) (ObfuscatedInstruction, bool, error) {
+	i := sort.Search(len(s.raw), func(i int) bool { return s.raw[i].Addr >= addr })
+	if i == len(s.raw) || s.raw[i].Addr != addr {
+		return ObfuscatedInstruction{}, false, nil
+	}
+	return s.instruction(i)
+}
+
+// Nearby returns up to n instructions in front of addr, followed by up to n instructions starting at addr
+func (s *InstructionStore) Nearby(addr uint64, n int) ([]ObfuscatedInstruction, error) {
+	i := sort.Search(len(s.raw), func(i int) bool { return s.raw[i].Addr >= addr })
+	first, last := i-n, i+n
+	if first < 0 {
+		first = 0
+	}
+	if last > len(s.raw) {
+		last = len(s.raw)
+	}
+	nearby := make([]ObfuscatedInstruction, 0, last-first)
+	for j := first; j < last; j++ {
+		inst, _, err := s.instruction(j)
+		if err != nil {
+			return nil, err
+		}
+		nearby = append(nearby, inst)
+	}
+	return nearby, nil
+}
+
+// Return the i-th instruction and decode its semantics, if necessary
+func (s *InstructionStore) instruction(i int) (ObfuscatedInstruction, bool, error) {
+	if s.decoded[i] == nil {
+		semantics, err := DecodeSemantics(s.raw[i].Semantics)
+		if err != nil {
+			return ObfuscatedInstruction{}, true, err
+		}
+		s.decoded[i] = &semantics
+	}
+	return ObfuscatedInstruction{
+		Semantics: *s.decoded[i],
+		Addr:      s.raw[i].Addr,
+		Region:    s.raw[i].Region,
+		Trap:      s.raw[i].Trap,
+	}, true, nil
+}
@@ -0,0 +1,81 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestInstructionStoreLookup(t *testing.T) {
+	input := testMetadata()[0].Instructions
+	input = append(input, ExportObfuscatedInstruction{Semantics: []byte{0xff}, Addr: 0x2000, Region: 0, Trap: TrapHalt})
+	s := NewInstructionStore(input)
+
+	tests := []struct {
+		addr  uint64
+		found bool
+		err   bool
+		want  Semantics
+	}{
+		{0x1010, true, false, testSemantics[0]},
+		{0x1ff0, true, false, testSemantics[8]},
+		{0x3008, true, false, testSemantics[3]},
+		{0x3008, true, false, testSemantics[3]}, // Cached
+		{0x2000, true, true, Semantics{}},
+		{0x1000, false, false, Semantics{}},
+		{0x1011, false, false, Semantics{}},
+		{0x4000, false, false, Semantics{}},
+	}
+	for _, test := range tests {
+		inst, found, err := s.Lookup(test.addr)
+		if found != test.found || (err != nil) != test.err {
+			t.Errorf("%#x: found %v, %v", test.addr, found, err)
+		} else if found && !test.err && (inst.Addr != test.addr || inst.Semantics != test.want) {
+			t.Errorf("%#x: looked up %+v", test.addr, inst)
+		}
+	}
+
+	if !reflect.DeepEqual(input, append(testMetadata()[0].Instructions, input[3])) {
+		t.Error("creating the store modified the input")
+	}
+}
+
+func TestInstructionStoreNearby(t *testing.T) {
+	var input []ExportObfuscatedInstruction
+	for _, addr := range []uint64{0x1050, 0x1040, 0x1030, 0x1020, 0x1010} {
+		input = append(input, ExportObfuscatedInstruction{Semantics: EncodeSemantics(testSemantics[5]), Addr: addr})
+	}
+	s := NewInstructionStore(input)
+
+	tests := []struct {
+		addr uint64
+		n    int
+		want []uint64
+	}{
+		{0x1030, 1, []uint64{0x1020, 0x1030}},
+		{0x1030, 2, []uint64{0x1010, 0x1020, 0x1030, 0x1040}},
+		{0x1028, 1, []uint64{0x1020, 0x1030}},
+		{0x1000, 2, []uint64{0x1010, 0x1020}},
+		{0x1010, 10, []uint64{0x1010, 0x1020, 0x1030, 0x1040, 0x1050}},
+		{0x2000, 2, []uint64{0x1040, 0x1050}},
+		{0x1030, 0, []uint64{}},
+	}
+	for _, test := range tests {
+		nearby, err := s.Nearby(test.addr, test.n)
+		if err != nil {
+			t.Errorf("%#x, %d: %v", test.addr, test.n, err)
+			continue
+		}
+		got := make([]uint64, len(nearby))
+		for i, inst := range nearby {
+			got[i] = inst.Addr
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%#x, %d = %#x, want %#x", test.addr, test.n, got, test.want)
+		}
+	}
+
+	s = NewInstructionStore(append(input, ExportObfuscatedInstruction{Semantics: []byte{0xff}, Addr: 0x1060}))
+	if nearby, err := s.Nearby(0x1050, 2); err == nil {
+		t.Errorf("decoded invalid semantics: %+v", nearby)
+	}
+}
@@ -1,20 +1,55 @@
 package common
 
-import (
-	"golang.org/x/arch/x86/x86asm"
-)
+// A region of code in the obfuscated binary, i.e. an executable section or segment
+type Region struct {
+	Name string `json:"name"`
+	Addr uint64 `json:"addr"`
+	Size uint64 `json:"size"`
+}
+
+// Metadata describes the obfuscated code regions and instructions of a binary or shared library
+// The name of a shared library is its soname.
+type Metadata struct {
+	Name         string                  `json:"name"`
+	Regions      []Region                `json:"regions"`
+	Instructions []ObfuscatedInstruction `json:"instructions"`
+}
 
-// Internal metadata contains the decoded instruction
+// External metadata contains the name, the regions and the external representation of the instructions
+type ExportMetadata struct {
+	Name         string                        `json:"name"`
+	Regions      []Region                      `json:"regions"`
+	Instructions []ExportObfuscatedInstruction `json:"instructions"`
+}
+
+// Internal metadata contains the semantics of the original instruction
+// Addr is the virtual address of the instruction relative to the load base of the ELF,
+// i.e. the address given by the ELF headers. Region is the index of the code region containing it.
+// Trap is the instruction the runtime writes over the original instruction.
 type ObfuscatedInstruction struct {
-	Inst   x86asm.Inst
-	Offset uint64
-	Binary []byte
+	Semantics Semantics `json:"semantics"`
+	Addr      uint64    `json:"addr"`
+	Region    uint16    `json:"region"`
+	Trap      Trap      `json:"trap"`
 }
 
-// External metadata only contains the instruction bytes and the offset
+// External metadata only contains the encoded semantics, the address, the region and the trap
+// The original instruction bytes aren't part of the metadata.
 type ExportObfuscatedInstruction struct {
-	Instruction []byte `json:"instruction"`
-	Offset uint64 `json:"offset"`
+	Semantics []byte `json:"semantics"`
+	Addr uint64 `json:"addr"`
+	Region uint16 `json:"region"`
+	Trap Trap `json:"trap"`
+}
+
+// Utility function
+// Conversion from internal metadata to external metadata including the regions
+func Export(input *Metadata) ExportMetadata {
+	return ExportMetadata{
+		Name:         input.Name,
+		Regions:      input.Regions,
+		Instructions: ExportObfuscatedInstructions(input.Instructions),
+	}
 }
 
 // Utility function
@@ -22,26 +57,10 @@ type ExportObfuscatedInstruction struct {
 func ExportObfuscatedInstructions(input []ObfuscatedInstruction) []ExportObfuscatedInstruction {
 	output := make([]ExportObfuscatedInstruction, len(input))
 	for i, obfInst := range input {
-		output[i].Offset = obfInst.Offset
-		output[i].Instruction = obfInst.Binary
+		output[i].Addr = obfInst.Addr
+		output[i].Region = obfInst.Region
+		output[i].Trap = obfInst.Trap
+		output[i].Semantics = EncodeSemantics(obfInst.Semantics)
 	}
 	return output
 }
-
-// Utility function
-// Conversion from external metadata to internal metadata
-func ImportObfuscatedInstructions(input []ExportObfuscatedInstruction) (map[uint64]ObfuscatedInstruction, error) {
-	output := make(map[uint64]ObfuscatedInstruction, len(input))
-	for _, data := range input {
-		inst, err := x86asm.Decode(data.Instruction, 64)
-		if err != nil {
-			return nil, err
-		}
-		output[data.Offset] = ObfuscatedInstruction{
-			Offset: data.Offset,
-			Binary: data.Instruction,
-			Inst: inst,
-		}
-	}
-	return output, nil
-}
@@ -0,0 +1,334 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// Semantics is the pre-decoded meaning of an obfuscated instruction
+// The obfuscator normalizes every obfuscated instruction into such a record, so the runtime
+// can perform it without decoding machine code.
+//
+//	KindJump, KindCall, KindLoop: Args[0] is the target
+//	KindRet:                      Args[0] is the number of additional bytes to release or OperandNone
+//	KindMove:                     Args[0] is the destination register, Args[1] the source
+//	KindSet:                      Args[0] is the destination
+type Semantics struct {
+	Kind     Kind       `json:"kind"`
+	Cond     Cond       `json:"cond"`
+	Len      uint8      `json:"len"`      // Length of the original instruction in bytes
+	AddrSize uint8      `json:"addrSize"` // Address size in bits
+	Args     [2]Operand `json:"args"`
+}
+
+// Kind of an obfuscated instruction
+type Kind uint8
+
+const (
+	KindJump Kind = iota // JMP, Jcc and JrCXZ
+	KindCall
+	KindRet
+	KindLoop // LOOP, LOOPE and LOOPNE
+	KindMove // CMOVcc
+	KindSet  // SETcc
+)
+
+var kindNames = [...]string{"jump", "call", "ret", "loop", "cmov", "set"}
+
+func (k Kind) String() string {
+	if int(k) < len(kindNames) {
+		return kindNames[k]
+	}
+	return fmt.Sprintf("Kind(%d)", k)
+}
+
+// Cond is the condition of an instruction
+type Cond uint8
+
+const (
+	CondAlways Cond = iota
+	CondO
+	CondNO
+	CondS
+	CondNS
+	CondE
+	CondNE
+	CondB
+	CondAE
+	CondBE
+	CondA
+	CondL
+	CondGE
+	CondLE
+	CondG
+	CondP
+	CondNP
+	CondCXZ // The counter register with the address size is zero
+)
+
+// OperandKind is the type of an operand
+type OperandKind uint8
+
+const (
+	OperandNone OperandKind = iota
+	OperandRel              // Imm is the displacement relative to the next instruction
+	OperandImm              // Imm is an immediate value
+	OperandReg              // Reg is a general purpose register
+	OperandMem              // Mem is the memory location of Size bytes
+)
+
+// Operand of an obfuscated instruction
+type Operand struct {
+	Kind OperandKind `json:"kind"`
+	Imm  int64       `json:"imm,omitempty"`
+	Reg  Reg         `json:"reg,omitempty"`
+	Mem  Memory      `json:"mem"`
+	Size uint8       `json:"size,omitempty"` // Size of the memory location in bytes
+}
+
+// Memory describes the effective address Segment:[Base + Scale*Index + Disp]
+type Memory struct {
+	Segment Reg   `json:"segment,omitempty"`
+	Base    Reg   `json:"base,omitempty"`
+	Index   Reg   `json:"index,omitempty"`
+	Scale   uint8 `json:"scale,omitempty"`
+	Disp    int64 `json:"disp,omitempty"`
+}
+
+// Reg is a register
+// The general purpose registers are grouped by size and ordered by their encoding.
+type Reg uint8
+
+const (
+	RegNone Reg = iota
+
+	// 8 bit
+	AL
+	CL
+	DL
+	BL
+	AH
+	CH
+	DH
+	BH
+	SPB
+	BPB
+	SIB
+	DIB
+	R8B
+	R9B
+	R10B
+	R11B
+	R12B
+	R13B
+	R14B
+	R15B
+
+	// 16 bit
+	AX
+	CX
+	DX
+	BX
+	SP
+	BP
+	SI
+	DI
+	R8W
+	R9W
+	R10W
+	R11W
+	R12W
+	R13W
+	R14W
+	R15W
+
+	// 32 bit
+	EAX
+	ECX
+	EDX
+	EBX
+	ESP
+	EBP
+	ESI
+	EDI
+	R8L
+	R9L
+	R10L
+	R11L
+	R12L
+	R13L
+	R14L
+	R15L
+
+	// 64 bit
+	RAX
+	RCX
+	RDX
+	RBX
+	RSP
+	RBP
+	RSI
+	RDI
+	R8
+	R9
+	R10
+	R11
+	R12
+	R13
+	R14
+	R15
+
+	// Instruction pointer
+	IP
+	EIP
+	RIP
+
+	// Segment registers
+	ES
+	CS
+	SS
+	DS
+	FS
+	GS
+)
+
+var regNames = [...]string{
+	"", "AL", "CL", "DL", "BL", "AH", "CH", "DH", "BH", "SPB", "BPB", "SIB", "DIB",
+	"R8B", "R9B", "R10B", "R11B", "R12B", "R13B", "R14B", "R15B",
+	"AX", "CX", "DX", "BX", "SP", "BP", "SI", "DI", "R8W", "R9W", "R10W", "R11W", "R12W", "R13W", "R14W", "R15W",
+	"EAX", "ECX", "EDX", "EBX", "ESP", "EBP", "ESI", "EDI", "R8L", "R9L", "R10L", "R11L", "R12L", "R13L", "R14L", "R15L",
+	"RAX", "RCX", "RDX", "RBX", "RSP", "RBP", "RSI", "RDI", "R8", "R9", "R10", "R11", "R12", "R13", "R14", "R15",
+	"IP", "EIP", "RIP", "ES", "CS", "SS", "DS", "FS", "GS",
+}
+
+func (r Reg) String() string {
+	if int(r) < len(regNames) {
+		return regNames[r]
+	}
+	return fmt.Sprintf("Reg(%d)", r)
+}
+
+// Registers are exported by name into the JSON debug export
+func (r Reg) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func (r *Reg) UnmarshalText(text []byte) error {
+	for i, name := range regNames {
+		if name == string(text) {
+			*r = Reg(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid register %q", text)
+}
+
+// EncodeSemantics serializes a semantic record
+//
+//	kind | cond | len | address size | args
+//	arg: kind | imm (signed varint) | reg | size | segment | base | index | scale | disp (signed varint)
+//
+// Only the fields relevant for the kind of the operand are present.
+func EncodeSemantics(s Semantics) []byte {
+	var buf bytes.Buffer
+	buf.Write([]byte{byte(s.Kind), byte(s.Cond), s.Len, s.AddrSize})
+	for _, arg := range s.Args {
+		buf.WriteByte(byte(arg.Kind))
+		switch arg.Kind {
+		case OperandRel, OperandImm:
+			writeVarint(&buf, arg.Imm)
+		case OperandReg:
+			buf.WriteByte(byte(arg.Reg))
+		case OperandMem:
+			buf.Write([]byte{arg.Size, byte(arg.Mem.Segment), byte(arg.Mem.Base), byte(arg.Mem.Index), arg.Mem.Scale})
+			writeVarint(&buf, arg.Mem.Disp)
+		}
+	}
+	return buf.Bytes()
+}
+
+// DecodeSemantics deserializes a semantic record
+func DecodeSemantics(data []byte) (Semantics, error) {
+	var s Semantics
+	r := bytes.NewReader(data)
+	header := make([]byte, 4)
+	if n, _ := r.Read(header); n != len(header) {
+		return s, ErrInvalidMetadata
+	}
+	s.Kind, s.Cond, s.Len, s.AddrSize = Kind(header[0]), Cond(header[1]), header[2], header[3]
+	if s.Kind > KindSet || s.Cond > CondCXZ {
+		return s, ErrInvalidMetadata
+	}
+
+	for i := range s.Args {
+		arg := &s.Args[i]
+		kind, err := r.ReadByte()
+		if err != nil {
+			return s, ErrInvalidMetadata
+		}
+		arg.Kind = OperandKind(kind)
+		switch arg.Kind {
+		case OperandNone:
+		case OperandRel, OperandImm:
+			if arg.Imm, err = binary.ReadVarint(r); err != nil {
+				return s, ErrInvalidMetadata
+			}
+		case OperandReg:
+			reg, err := r.ReadByte()
+			if err != nil {
+				return s, ErrInvalidMetadata
+			}
+			arg.Reg = Reg(reg)
+		case OperandMem:
+			mem := make([]byte, 5)
+			if n, _ := r.Read(mem); n != len(mem) {
+				return s, ErrInvalidMetadata
+			}
+			arg.Size = mem[0]
+			arg.Mem = Memory{Segment: Reg(mem[1]), Base: Reg(mem[2]), Index: Reg(mem[3]), Scale: mem[4]}
+			if arg.Mem.Disp, err = binary.ReadVarint(r); err != nil {
+				return s, ErrInvalidMetadata
+			}
+		default:
+			return s, ErrInvalidMetadata
+		}
+	}
+
+	if r.Len() != 0 {
+		return s, ErrInvalidMetadata
+	}
+	return s, nil
+}
+
+func writeVarint(buf *bytes.Buffer, x int64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutVarint(b[:], x)])
+}
+
+func (m Memory) String() string {
+	var s string
+	if m.Segment != RegNone {
+		s = m.Segment.String() + ":"
+	}
+	s += "["
+	if m.Base != RegNone {
+		s += m.Base.String()
+	}
+	if m.Index != RegNone {
+		if m.Base != RegNone {
+			s += "+"
+		}
+		s += fmt.Sprintf("%d*%v", m.Scale, m.Index)
+	}
+	if m.Disp != 0 || (m.Base == RegNone && m.Index == RegNone) {
+		if m.Disp < 0 {
+			s += fmt.Sprintf("-%#x", -m.Disp)
+		} else if m.Base != RegNone || m.Index != RegNone {
+			s += fmt.Sprintf("+%#x", m.Disp)
+		} else {
+			s += fmt.Sprintf("%#x", m.Disp)
+		}
+	}
+	return s + "]"
+}
@@ -0,0 +1,47 @@
+package common
+
+import "testing"
+
+var testSemantics = []Semantics{
+	{Kind: KindJump, Cond: CondNE, Len: 2, AddrSize: 64, Args: [2]Operand{{Kind: OperandRel, Imm: -2}}},
+	{Kind: KindJump, Cond: CondCXZ, Len: 3, AddrSize: 32, Args: [2]Operand{{Kind: OperandRel, Imm: 0x7fffffff}}},
+	{Kind: KindCall, Len: 2, AddrSize: 64, Args: [2]Operand{{Kind: OperandReg, Reg: RAX}}},
+	{Kind: KindCall, Len: 6, AddrSize: 64, Args: [2]Operand{{Kind: OperandMem, Size: 8, Mem: Memory{Base: RBX, Disp: -0x100}}}},
+	{Kind: KindJump, Len: 8, AddrSize: 32, Args: [2]Operand{{Kind: OperandMem, Size: 8,
+		Mem: Memory{Segment: FS, Base: EAX, Index: ECX, Scale: 4, Disp: -0x80000000}}}},
+	{Kind: KindRet, Len: 1, AddrSize: 64},
+	{Kind: KindRet, Len: 3, AddrSize: 64, Args: [2]Operand{{Kind: OperandImm, Imm: 0x10}}},
+	{Kind: KindLoop, Cond: CondE, Len: 2, AddrSize: 64, Args: [2]Operand{{Kind: OperandRel, Imm: -0x80}}},
+	{Kind: KindMove, Cond: CondG, Len: 10, AddrSize: 64, Args: [2]Operand{{Kind: OperandReg, Reg: R15L},
+		{Kind: OperandMem, Size: 4, Mem: Memory{Segment: GS, Base: RIP, Disp: 0x28}}}},
+	{Kind: KindSet, Cond: CondP, Len: 4, AddrSize: 64, Args: [2]Operand{{Kind: OperandMem, Size: 1, Mem: Memory{Base: RBP, Disp: -0x10}}}},
+}
+
+func TestSemanticsRoundTrip(t *testing.T) {
+	for _, s := range testSemantics {
+		got, err := DecodeSemantics(EncodeSemantics(s))
+		if err != nil {
+			t.Errorf("%v: %v", s, err)
+		} else if got != s {
+			t.Errorf("%v: decoded as %v", s, got)
+		}
+	}
+}
+
+func TestDecodeSemanticsInvalid(t *testing.T) {
+	valid := EncodeSemantics(testSemantics[4])
+	tests := map[string][]byte{
+		"empty":            {},
+		"truncated header": valid[:3],
+		"truncated":        valid[:len(valid)-1],
+		"trailing data":    append(append([]byte(nil), valid...), 0),
+		"invalid kind":     {byte(KindSet + 1), 0, 1, 64, 0, 0},
+		"invalid cond":     {byte(KindJump), byte(CondCXZ + 1), 1, 64, 0, 0},
+		"invalid operand":  {byte(KindJump), 0, 1, 64, byte(OperandMem + 1), 0},
+	}
+	for name, data := range tests {
+		if s, err := DecodeSemantics(data); err != ErrInvalidMetadata {
+			t.Errorf("%s: decoded as %v, %v", name, s, err)
+		}
+	}
+}
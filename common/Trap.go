@@ -0,0 +1,111 @@
+package common
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+// Trap is the instruction written over an obfuscated instruction at runtime
+// Executing it stops the thread, so the runtime can perform the original instruction instead.
+// Apart from INT3, all of them are valid traps, because they never occur in regular code.
+type Trap uint8
+
+const (
+	TrapInt3       Trap = iota // INT3, SIGTRAP after the trap
+	TrapInt1                   // INT1 (ICEBP), SIGTRAP after the trap
+	TrapUD2                    // UD2, SIGILL at the trap
+	TrapHalt                   // HLT, SIGSEGV at the trap
+	TrapPrivileged             // CLI, STI and port I/O, SIGSEGV at the trap
+	TrapInvalid                // Opcodes invalid in 64 bit mode, SIGILL at the trap
+	TrapMemory                 // Load from an unmapped address, SIGSEGV at the trap
+)
+
+var trapNames = [...]string{"int3", "int1", "ud2", "hlt", "priv", "invalid", "mem"}
+
+// MemoryTrapLimit is the end of the first page, which contains the addresses loaded by TrapMemory
+// It can't be mapped unless vm.mmap_min_addr is set to 0.
+const MemoryTrapLimit = 0x1000
+
+// Possible encodings of each trap, all encodings of a trap have the same length
+var trapCodes = [...][][]byte{
+	TrapInt3:       {{0xCC}},
+	TrapInt1:       {{0xF1}},
+	TrapUD2:        {{0x0F, 0x0B}},
+	TrapHalt:       {{0xF4}},
+	TrapPrivileged: {{0xFA}, {0xFB}, {0xEC}, {0xED}, {0xEE}, {0xEF}, {0x6C}, {0x6D}, {0x6E}, {0x6F}},
+	TrapInvalid: {{0x06}, {0x07}, {0x0E}, {0x16}, {0x17}, {0x1E}, {0x1F}, {0x27}, {0x2F}, {0x37}, {0x3F},
+		{0x60}, {0x61}, {0xCE}, {0xD4}, {0xD5}, {0xD6}},
+	TrapMemory: memoryTrapCodes(),
+}
+
+// Loads of any register from a few addresses in the first page by MOV, CMP and TEST
+// The ModRM and SIB bytes select an absolute 32 bit address without base and index.
+func memoryTrapCodes() [][]byte {
+	var codes [][]byte
+	for _, op := range []byte{0x8A, 0x8B, 0x3A, 0x3B, 0x84, 0x85} {
+		for reg := byte(0); reg < 8; reg++ {
+			for _, addr := range []uint32{0x0, 0x8, 0x10, 0x18, 0x40, 0x80, 0x100, 0x800} {
+				code := []byte{op, reg<<3 | 4, 0x25, 0, 0, 0, 0}
+				binary.LittleEndian.PutUint32(code[3:], addr)
+				codes = append(codes, code)
+			}
+		}
+	}
+	return codes
+}
+
+// Codes returns the possible encodings of the trap
+func (t Trap) Codes() [][]byte {
+	if int(t) >= len(trapCodes) {
+		return trapCodes[TrapInt3]
+	}
+	return trapCodes[t]
+}
+
+// Len returns the length of the trap in bytes
+func (t Trap) Len() uint8 {
+	return uint8(len(t.Codes()[0]))
+}
+
+// Signal returns the signal the kernel reports for the trap
+func (t Trap) Signal() syscall.Signal {
+	switch t {
+	case TrapUD2, TrapInvalid:
+		return syscall.SIGILL
+	case TrapHalt, TrapPrivileged, TrapMemory:
+		return syscall.SIGSEGV
+	}
+	return syscall.SIGTRAP
+}
+
+func (t Trap) String() string {
+	if int(t) < len(trapNames) {
+		return trapNames[t]
+	}
+	return fmt.Sprintf("trap%d", uint8(t))
+}
+
+// ParseTraps parses a comma-separated list of trap names, "all" selects all traps
+func ParseTraps(list string) ([]Trap, error) {
+	var traps []Trap
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "all" {
+			traps = append(traps, TrapInt3, TrapInt1, TrapUD2, TrapHalt, TrapPrivileged, TrapInvalid, TrapMemory)
+			continue
+		}
+		found := false
+		for t, n := range trapNames {
+			if n == name {
+				traps = append(traps, Trap(t))
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown trap %q", name)
+		}
+	}
+	return traps, nil
+}
@@ -0,0 +1,52 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTraps(t *testing.T) {
+	tests := []struct {
+		list string
+		want []Trap
+	}{
+		{"int3", []Trap{TrapInt3}},
+		{"ud2, hlt", []Trap{TrapUD2, TrapHalt}},
+		{"priv,invalid,int1", []Trap{TrapPrivileged, TrapInvalid, TrapInt1}},
+		{"mem", []Trap{TrapMemory}},
+		{"all", []Trap{TrapInt3, TrapInt1, TrapUD2, TrapHalt, TrapPrivileged, TrapInvalid, TrapMemory}},
+	}
+	for _, test := range tests {
+		got, err := ParseTraps(test.list)
+		if err != nil {
+			t.Errorf("%q: %v", test.list, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q = %v, want %v", test.list, got, test.want)
+		}
+	}
+
+	for _, list := range []string{"", "int4", "int3,", "ALL"} {
+		if got, err := ParseTraps(list); err == nil {
+			t.Errorf("%q = %v, expected error", list, got)
+		}
+	}
+}
+
+func TestTrapNames(t *testing.T) {
+	for trap := range trapCodes {
+		got, err := ParseTraps(Trap(trap).String())
+		if err != nil || len(got) != 1 || got[0] != Trap(trap) {
+			t.Errorf("%v: parsed as %v, %v", Trap(trap), got, err)
+		}
+	}
+}
+
+func TestTrapCodes(t *testing.T) {
+	for trap := range trapCodes {
+		for _, code := range Trap(trap).Codes() {
+			if len(code) != int(Trap(trap).Len()) {
+				t.Errorf("%v: encoding % x has length %d, want %d", Trap(trap), code, len(code), Trap(trap).Len())
+			}
+		}
+	}
+}
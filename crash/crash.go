@@ -0,0 +1,113 @@
+package crash
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/BlobbyBob/PtraceObfuscator/common"
+	"io/ioutil"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Report describes the state of a thread of the tracee, when the runtime failed to handle its stop
+// It is written as JSON, so it can be attached to bug reports and processed by tools.
+type Report struct {
+	Time        time.Time      `json:"time"`
+	Pid         int            `json:"pid"`
+	Tid         int            `json:"tid"`
+	Signal      string         `json:"signal,omitempty"` // Signal the thread stopped with
+	Error       string         `json:"error"`
+	Registers   map[string]Hex `json:"registers"`
+	Memory      []Memory       `json:"memory"`
+	Disassembly []Instruction  `json:"disassembly,omitempty"`
+	Maps        []string       `json:"maps,omitempty"`     // Memory mappings of the process
+	Metadata    []Site         `json:"metadata,omitempty"` // Obfuscated instructions next to the instruction pointer
+	History     []Breakpoint   `json:"history,omitempty"`  // Most recently handled breakpoints, oldest first
+}
+
+// Hex is an address or register value, which is written as hexadecimal string
+type Hex uint64
+
+func (h Hex) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("0x%x", uint64(h))), nil
+}
+
+// Memory is a dump of the memory of the tracee
+type Memory struct {
+	Name  string `json:"name"`
+	Addr  Hex    `json:"addr"`
+	Bytes string `json:"bytes"` // Hexadecimal, empty if the memory isn't readable
+}
+
+// Site is an obfuscated instruction from the metadata
+type Site struct {
+	Module    string           `json:"module"`
+	Addr      Hex              `json:"addr"`    // Address in the ELF file
+	Runtime   Hex              `json:"runtime"` // Address in the process
+	Trap      string           `json:"trap"`
+	Semantics common.Semantics `json:"semantics"`
+}
+
+// Reader reads the memory of a thread and returns the number of bytes read
+type Reader func(addr uintptr, data []byte) (int, error)
+
+// Sizes of the memory dumps around the instruction pointer and at the stack pointer
+const (
+	codeBefore = 32
+	codeAfter  = 32
+	stackSize  = 256
+)
+
+// New creates a report for a thread and dumps the memory around the instruction pointer and the top of the stack
+func New(pid, tid int, sig syscall.Signal, err error, regs *syscall.PtraceRegs, read Reader) *Report {
+	r := &Report{
+		Time:      time.Now(),
+		Pid:       pid,
+		Tid:       tid,
+		Error:     err.Error(),
+		Registers: Registers(regs),
+	}
+	if sig != 0 {
+		r.Signal = sig.String()
+	}
+	r.Dump("code", regs.Rip-codeBefore, codeBefore+codeAfter, read)
+	r.Dump("stack", regs.Rsp, stackSize, read)
+	return r
+}
+
+// Dump a region of memory into the report
+func (r *Report) Dump(name string, addr uint64, size int, read Reader) {
+	data := make([]byte, size)
+	n, _ := read(uintptr(addr), data)
+	if n < 0 {
+		n = 0
+	}
+	r.Memory = append(r.Memory, Memory{Name: name, Addr: Hex(addr), Bytes: fmt.Sprintf("%x", data[:n])})
+}
+
+// AddMaps adds the contents of /proc/pid/maps to the report
+func (r *Report) AddMaps(maps []byte) {
+	r.Maps = strings.Split(strings.TrimSpace(string(maps)), "\n")
+}
+
+// Registers returns the general purpose, instruction pointer, flags and segment base registers by name
+func Registers(regs *syscall.PtraceRegs) map[string]Hex {
+	return map[string]Hex{
+		"rax": Hex(regs.Rax), "rbx": Hex(regs.Rbx), "rcx": Hex(regs.Rcx), "rdx": Hex(regs.Rdx),
+		"rsi": Hex(regs.Rsi), "rdi": Hex(regs.Rdi), "rbp": Hex(regs.Rbp), "rsp": Hex(regs.Rsp),
+		"r8": Hex(regs.R8), "r9": Hex(regs.R9), "r10": Hex(regs.R10), "r11": Hex(regs.R11),
+		"r12": Hex(regs.R12), "r13": Hex(regs.R13), "r14": Hex(regs.R14), "r15": Hex(regs.R15),
+		"rip": Hex(regs.Rip), "eflags": Hex(regs.Eflags), "orig_rax": Hex(regs.Orig_rax),
+		"fs_base": Hex(regs.Fs_base), "gs_base": Hex(regs.Gs_base),
+	}
+}
+
+// Write the report into a JSON file
+func (r *Report) Write(file string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, append(data, '\n'), 0644)
+}
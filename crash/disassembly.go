@@ -0,0 +1,79 @@
+package crash
+
+import (
+	"fmt"
+	"golang.org/x/arch/x86/x86asm"
+)
+
+// Instruction is a disassembled instruction of the tracee
+type Instruction struct {
+	Addr    Hex    `json:"addr"`
+	Bytes   string `json:"bytes"`
+	Text    string `json:"text"`
+	Current bool   `json:"current,omitempty"` // Whether the thread stopped at this instruction
+}
+
+// Disassemble the code around addr, which is assumed to be the start of an instruction
+// As the start of the preceding instructions is unknown, the disassembly starts at the earliest
+// address in front of addr, from which decoding the instructions linearly hits addr.
+// Obfuscated instructions are replaced by a trap followed by random data, so the ones in r.Metadata
+// are skipped as a whole. Thus, the metadata should be added first.
+func (r *Report) Disassemble(addr uint64, read Reader) {
+	sites := make(map[uint64]Site, len(r.Metadata))
+	for _, site := range r.Metadata {
+		sites[uint64(site.Runtime)] = site
+	}
+
+	start := addr - codeBefore
+	code := make([]byte, codeBefore+codeAfter)
+	n, _ := read(uintptr(start), code)
+	if n <= codeBefore {
+		// The memory in front of addr might not be mapped
+		start = addr
+		n, _ = read(uintptr(start), code[:codeAfter])
+	}
+	if n <= 0 {
+		return
+	}
+	code = code[:n]
+
+	for offset := uint64(0); start+offset < addr; offset++ {
+		if insts, ok := disassemble(code[offset:], start+offset, addr, sites); ok {
+			r.Disassembly = insts
+			return
+		}
+	}
+	r.Disassembly, _ = disassemble(code[addr-start:], addr, addr, sites)
+}
+
+// Decode code at base linearly and report, whether an instruction starts at addr
+// Bytes, which can't be decoded, are skipped one at a time.
+func disassemble(code []byte, base, addr uint64, sites map[uint64]Site) ([]Instruction, bool) {
+	var insts []Instruction
+	hit := false
+	for i := 0; i < len(code); {
+		a := base + uint64(i)
+		if a > addr && !hit {
+			return nil, false
+		}
+		hit = hit || a == addr
+
+		size, text := 1, "(bad)"
+		if site, obfuscated := sites[a]; obfuscated && site.Semantics.Len > 0 {
+			size, text = int(site.Semantics.Len), fmt.Sprintf("(obfuscated, %s)", site.Trap)
+		} else if inst, err := x86asm.Decode(code[i:], 64); err == nil {
+			size, text = inst.Len, x86asm.IntelSyntax(inst, a, nil)
+		}
+		if i+size > len(code) {
+			break
+		}
+		insts = append(insts, Instruction{
+			Addr:    Hex(a),
+			Bytes:   fmt.Sprintf("%x", code[i:i+size]),
+			Text:    text,
+			Current: a == addr,
+		})
+		i += size
+	}
+	return insts, hit
+}
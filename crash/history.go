@@ -0,0 +1,42 @@
+package crash
+
+// Breakpoint is a breakpoint handled by the runtime
+type Breakpoint struct {
+	Tid    int    `json:"tid"`
+	Module string `json:"module"`
+	Addr   Hex    `json:"addr"` // Address in the ELF file
+	Rip    Hex    `json:"rip"`  // Address in the process
+}
+
+// History keeps the most recently handled breakpoints in a ring buffer
+type History struct {
+	entries []Breakpoint
+	next    int
+	full    bool
+}
+
+// NewHistory creates a history of the last n breakpoints
+func NewHistory(n int) *History {
+	return &History{entries: make([]Breakpoint, n)}
+}
+
+// Add a handled breakpoint
+func (h *History) Add(b Breakpoint) {
+	if len(h.entries) == 0 {
+		return
+	}
+	h.entries[h.next] = b
+	h.next++
+	if h.next == len(h.entries) {
+		h.next = 0
+		h.full = true
+	}
+}
+
+// Entries returns the breakpoints, oldest first
+func (h *History) Entries() []Breakpoint {
+	if !h.full {
+		return append([]Breakpoint(nil), h.entries[:h.next]...)
+	}
+	return append(append([]Breakpoint(nil), h.entries[h.next:]...), h.entries[:h.next]...)
+}
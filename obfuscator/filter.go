@@ -0,0 +1,87 @@
+package obfuscator
+
+import (
+	"debug/elf"
+	"github.com/BlobbyBob/PtraceObfuscator/common"
+	"log"
+	"regexp"
+)
+
+// Range of addresses in an ELF file
+type Range struct {
+	Start, End uint64 // End is exclusive
+}
+
+// Contains checks whether an address lies within the range
+func (r Range) Contains(addr uint64) bool {
+	return addr >= r.Start && addr < r.End
+}
+
+// FunctionRanges determines the address ranges of all functions whose symbol names match one of the patterns
+// The symbols are read from the symbol table and the dynamic symbol table, so this has to be done before
+// stripping the file.
+func FunctionRanges(filename string, patterns []*regexp.Regexp) ([]Range, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	file, err := elf.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	symbols, err := file.Symbols()
+	if err != nil && err != elf.ErrNoSymbols {
+		return nil, err
+	}
+	dynamic, err := file.DynamicSymbols()
+	if err != nil && err != elf.ErrNoSymbols {
+		return nil, err
+	}
+
+	ranges := make([]Range, 0)
+	seen := make(map[Range]bool)
+	for _, symbol := range append(symbols, dynamic...) {
+		if elf.ST_TYPE(symbol.Info) != elf.STT_FUNC || symbol.Size == 0 || symbol.Section == elf.SHN_UNDEF {
+			continue
+		}
+		for _, pattern := range patterns {
+			r := Range{Start: symbol.Value, End: symbol.Value + symbol.Size}
+			if pattern.MatchString(symbol.Name) && !seen[r] {
+				seen[r] = true
+				ranges = append(ranges, r)
+				break
+			}
+		}
+	}
+	return ranges, nil
+}
+
+// Filter the instructions by the included and excluded address ranges
+func filterInstructions(candidates []common.ObfuscatedInstruction, options Options) []common.ObfuscatedInstruction {
+	if options.Include == nil && len(options.Exclude) == 0 {
+		return candidates
+	}
+
+	selected := make([]common.ObfuscatedInstruction, 0, len(candidates))
+	for _, c := range candidates {
+		if options.Include != nil && !inRanges(options.Include, c.Addr) {
+			continue
+		}
+		if inRanges(options.Exclude, c.Addr) {
+			continue
+		}
+		selected = append(selected, c)
+	}
+	log.Printf("Filtered out %d instructions", len(candidates)-len(selected))
+	return selected
+}
+
+func inRanges(ranges []Range, addr uint64) bool {
+	for _, r := range ranges {
+		if r.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,29 @@
+package obfuscator
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFilterInstructions(t *testing.T) {
+	tests := []struct {
+		name    string
+		include []Range
+		exclude []Range
+		want    []uint64
+	}{
+		{"no filter", nil, nil, []uint64{0x1000, 0x1010, 0x1020, 0x2000, 0x3000}},
+		{"empty include", []Range{}, nil, []uint64{}},
+		{"include", []Range{{0x1000, 0x1020}, {0x3000, 0x3001}}, nil, []uint64{0x1000, 0x1010, 0x3000}},
+		{"exclude", nil, []Range{{0x1010, 0x2001}}, []uint64{0x1000, 0x3000}},
+		{"exclude wins", []Range{{0x1000, 0x2000}}, []Range{{0x1010, 0x1011}}, []uint64{0x1000, 0x1020}},
+		{"end exclusive", []Range{{0x0, 0x1000}, {0x2000, 0x3000}}, nil, []uint64{0x2000}},
+	}
+	for _, test := range tests {
+		got := filterInstructions(testCandidates(0x1000, 0x1010, 0x1020, 0x2000, 0x3000),
+			Options{Include: test.include, Exclude: test.exclude})
+		if !reflect.DeepEqual(addrs(got), test.want) {
+			t.Errorf("%s: filtered to %#x, want %#x", test.name, addrs(got), test.want)
+		}
+	}
+}
@@ -2,17 +2,14 @@ package obfuscator
 
 import (
 	"debug/elf"
+	"encoding/binary"
+	"fmt"
 	"github.com/BlobbyBob/PtraceObfuscator/common"
 	"golang.org/x/arch/x86/x86asm"
 	"io/ioutil"
 	"log"
 	"math/rand"
-	"time"
-)
-
-var (
-	randVal uint64
-	randBytes byte
+	"sort"
 )
 
 const (
@@ -20,6 +17,7 @@ const (
 	Recursive = 1
 	Nop = 0
 	Rand = 2
+	DataFlow = 4
 )
 
 // Obfuscator
@@ -28,91 +26,156 @@ const (
 // or with random data.
 //
 //    filename - Valid path to an ELF file
-//    mode     - Combination of {Linear|Recursive} | {Nop|Rand}
+//    mode     - Combination of {Linear|Recursive} | {Nop|Rand} | DataFlow
 //               Be aware, that the recursive disassembler will not work well on most binaries.
+//               DataFlow additionally obfuscates conditional moves and sets.
+//    options  - Selection of the instructions to obfuscate, e.g. based on a profile
 //
 //    Return values:
 //    - []byte containing the obfuscated binary
-//    - *[]common.ObfuscatedInstruction containing information about the replaced instructions
+//    - *common.Metadata containing information about the obfuscated code regions and the replaced instructions
 //    - error
-func Obfuscate(filename string, mode int) (obfElf []byte, obfInst *[]common.ObfuscatedInstruction, err error) {
+func Obfuscate(filename string, mode int, options Options) (obfElf []byte, metadata *common.Metadata, err error) {
 	file, err := elf.Open(filename)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	// Read bytes from text section
-	textSection := file.Section(".text")
-	textReader := textSection.Open()
-	code := make([]byte, 0)
-	for {
-		codeBit := make([]byte, 8)
-		n, err := textReader.Read(codeBit)
-		if err != nil {
-			break
-		}
-		code = append(code, codeBit[:n]...)
+	elfContents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	// Disassemble text section
-	err = nil
-	obfuscatedInstructions := make([]common.ObfuscatedInstruction, 0)
-	if mode&1 == Linear {
-		linearDisassembler(code, &obfuscatedInstructions, textSection.Offset)
-	} else if mode&1 == Recursive {
-		recursiveDisassembler(code, &obfuscatedInstructions, textSection.Offset, file.Entry)
+	// Disassemble all code regions
+	metadata = new(common.Metadata)
+	metadata.Instructions = make([]common.ObfuscatedInstruction, 0)
+	regions := codeRegions(file, elfContents)
+	for _, region := range regions {
+		if region.Offset+region.Size > uint64(len(elfContents)) {
+			return nil, nil, fmt.Errorf("region %v exceeds the file", region.Name)
+		}
+		code := elfContents[region.Offset : region.Offset+region.Size]
+
+		first := len(metadata.Instructions)
+		if mode&1 == Linear {
+			linearDisassembler(code, &metadata.Instructions, region.Addr, mode)
+		} else if mode&1 == Recursive {
+			// Without a starting point, we can't disassemble a region recursively
+			if file.Entry >= region.Addr && file.Entry < region.Addr+region.Size {
+				recursiveDisassembler(code, &metadata.Instructions, region.Addr, file.Entry, mode)
+			}
+		}
+		for i := first; i < len(metadata.Instructions); i++ {
+			metadata.Instructions[i].Region = uint16(len(metadata.Regions))
+		}
+		log.Printf("Obfuscated %d instructions in %v", len(metadata.Instructions)-first, region.Name)
+		metadata.Regions = append(metadata.Regions, region.Region)
 	}
 
-	// Rand init
-	rand.Seed(time.Now().UnixNano())
-	randBytes = 0
+	// All random decisions are derived from the seed, so the output is reproducible
+	rng := rand.New(rand.NewSource(options.Seed))
+	random := &randomBytes{rng: rng}
 
-	log.Printf("Obfuscated %d instructions", len(obfuscatedInstructions))
+	metadata.Instructions = filterInstructions(metadata.Instructions, options)
+	metadata.Instructions = thinInstructions(metadata.Instructions, options.Density, rng)
+	metadata.Instructions = selectInstructions(metadata.Instructions, options)
+	chooseTraps(metadata.Instructions, options.Traps, rng)
 
-	// Generate obfuscated binary
-	elfContents, err := ioutil.ReadFile(filename)
-	if err != nil {
-		return nil, nil, err
-	}
+	log.Printf("Obfuscated %d instructions", len(metadata.Instructions))
 
+	// Generate obfuscated binary
 	obfuscatedElf := make([]byte, len(elfContents))
+	copy(obfuscatedElf, elfContents)
 
-	for offset, data := range elfContents {
-		// Obfuscate matched instructions in text section
-		if uint64(offset) >= textSection.Offset && uint64(offset) < textSection.Offset+textSection.Size {
-			relOffset := uint64(offset) - textSection.Offset
-			isJump := false
-			for _, jump := range obfuscatedInstructions {
-				if relOffset >= jump.Offset && relOffset < jump.Offset+uint64(jump.Inst.Len) {
-					isJump = true
-				}
+	sort.Slice(metadata.Instructions, func(i, j int) bool {
+		return metadata.Instructions[i].Addr < metadata.Instructions[j].Addr
+	})
+	for _, jump := range metadata.Instructions {
+		region := regions[jump.Region]
+		offset := jump.Addr - region.Addr + region.Offset
+		for i := offset; i < offset+uint64(jump.Semantics.Len); i++ {
+			if mode&2 == Rand {
+				obfuscatedElf[i] = random.randByte()
+			} else if mode&2 == Nop {
+				obfuscatedElf[i] = 0x90
 			}
-			if isJump {
-				if mode&2 == Rand {
-					obfuscatedElf[offset] = randByte()
-				} else if mode&2 == Nop {
-					obfuscatedElf[offset] = 0x90
-				}
-			} else {
-				obfuscatedElf[offset] = data
+		}
+	}
+
+	return obfuscatedElf, metadata, nil
+}
+
+// A code region together with its location in the file
+type codeRegion struct {
+	common.Region
+	Offset uint64
+}
+
+// Determine the code regions of an ELF file
+// These are all executable sections. If the section headers are missing, e.g. in binaries stripped with sstrip,
+// we fall back to the executable segments.
+func codeRegions(file *elf.File, contents []byte) []codeRegion {
+	regions := make([]codeRegion, 0)
+	for _, section := range file.Sections {
+		if section.Type == elf.SHT_PROGBITS && section.Flags&elf.SHF_EXECINSTR != 0 && section.Size > 0 {
+			regions = append(regions, codeRegion{
+				Region: common.Region{Name: section.Name, Addr: section.Addr, Size: section.Size},
+				Offset: section.Offset,
+			})
+		}
+	}
+	if len(regions) > 0 {
+		return regions
+	}
+
+	// The ELF header and program headers might be part of an executable segment, but they aren't code
+	// This is only correct for 64 bit ELF files, which are the only ones we support anyway
+	headersEnd := uint64(0)
+	if len(contents) >= 0x40 {
+		phoff := binary.LittleEndian.Uint64(contents[0x20:])
+		phentsize := uint64(binary.LittleEndian.Uint16(contents[0x36:]))
+		phnum := uint64(binary.LittleEndian.Uint16(contents[0x38:]))
+		headersEnd = phoff + phentsize*phnum
+	}
+
+	for i, prog := range file.Progs {
+		if prog.Type != elf.PT_LOAD || prog.Flags&elf.PF_X == 0 {
+			continue
+		}
+		region := codeRegion{
+			Region: common.Region{Name: fmt.Sprintf("segment%d", i), Addr: prog.Vaddr, Size: prog.Filesz},
+			Offset: prog.Off,
+		}
+		if region.Offset < headersEnd {
+			if region.Offset+region.Size <= headersEnd {
+				continue
 			}
-		} else {
-			obfuscatedElf[offset] = data
+			skip := headersEnd - region.Offset
+			region.Offset += skip
+			region.Addr += skip
+			region.Size -= skip
 		}
+		regions = append(regions, region)
 	}
+	return regions
+}
 
-	return obfuscatedElf, &obfuscatedInstructions, nil
+// Source of random bytes for overwriting the obfuscated instructions
+type randomBytes struct {
+	rng   *rand.Rand
+	val   uint64
+	bytes byte
 }
 
 // Produce a single random byte, but do not waste the other bytes returned by rand.* functions
-func randByte() byte {
-	if randBytes == 0 {
-		randVal = rand.Uint64()
-		randBytes = 8
+func (r *randomBytes) randByte() byte {
+	if r.bytes == 0 {
+		r.val = r.rng.Uint64()
+		r.bytes = 8
 	}
-	randBytes--
-	v := byte(randVal & 0xff)
-	randVal >>= 8
+	r.bytes--
+	v := byte(r.val & 0xff)
+	r.val >>= 8
 	return v
 }
 
@@ -120,7 +183,7 @@ func randByte() byte {
 //
 // This function not only disassembles, but also decides, what produces the metadata
 // If an error occurs, the function will return the partial result
-func linearDisassembler(code []byte, obfInst *[]common.ObfuscatedInstruction, textOffset uint64) {
+func linearDisassembler(code []byte, obfInst *[]common.ObfuscatedInstruction, textAddr uint64, mode int) {
 	i := 0
 	for i < len(code) {
 		// Dirty hack to catch unknown instruction endbr64
@@ -146,17 +209,20 @@ func linearDisassembler(code []byte, obfInst *[]common.ObfuscatedInstruction, te
 
 		// Circumventing issues, when an instruction gets decoded as prefix
 		if inst.Opcode == 0 && inst.Prefix[0] != 0 {
-			log.Printf("offset 0x%x: warn: encountered instruction '%v', which is most likely decoded incorrectly. stopping here\n", uint64(i)+textOffset, inst)
+			log.Printf("offset 0x%x: warn: encountered instruction '%v', which is most likely decoded incorrectly. stopping here\n", uint64(i)+textAddr, inst)
 			break
 		}
 
 		// Find instructions to obfuscate
-		if obfuscateInstruction(inst) {
-			*obfInst = append(*obfInst, common.ObfuscatedInstruction{
-				Inst:   inst,
-				Offset: uint64(i),
-				Binary: code[i : i+inst.Len],
-			})
+		if obfuscateInstruction(inst, mode) {
+			if sem, err := semantics(inst); err != nil {
+				log.Printf("offset 0x%x: not obfuscating: %v\n", uint64(i)+textAddr, err)
+			} else {
+				*obfInst = append(*obfInst, common.ObfuscatedInstruction{
+					Semantics: sem,
+					Addr:      uint64(i) + textAddr,
+				})
+			}
 		}
 		i += inst.Len
 	}
@@ -171,15 +237,15 @@ func linearDisassembler(code []byte, obfInst *[]common.ObfuscatedInstruction, te
 //          only have a call to _libc_start_main(..., main, ...) at the entrypoint. However, for general
 //          programs we cannot assume, that a value in a register points to valid instructions. Only
 //          hardcoding this condition would help here.
-func recursiveDisassembler(code []byte, obfInst *[]common.ObfuscatedInstruction, textOffset uint64, entrypoint uint64) {
+func recursiveDisassembler(code []byte, obfInst *[]common.ObfuscatedInstruction, textAddr uint64, entrypoint uint64, mode int) {
 	codeLen := uint64(len(code))
 	stack := make([]uint64, 0)
-	stack = append(stack, entrypoint-textOffset)
-	// log.Printf("PUSH %04x", entrypoint-textOffset)
+	stack = append(stack, entrypoint-textAddr)
+	// log.Printf("PUSH %04x", entrypoint-textAddr)
 	visited := make(map[uint64]interface{})
 	for len(stack) > 0 {
 		i := stack[len(stack)-1]
-		// log.Printf("POP  %04x", entrypoint-textOffset)
+		// log.Printf("POP  %04x", entrypoint-textAddr)
 		stack = stack[:len(stack)-1]
 		if _, exists := visited[i]; exists {
 			continue
@@ -214,7 +280,7 @@ func recursiveDisassembler(code []byte, obfInst *[]common.ObfuscatedInstruction,
 
 			// Prefix Bug
 			if inst.Opcode == 0 && inst.Prefix[0] != 0 {
-				log.Printf("offset 0x%x: warn: encountered instruction '%v', which is most likely decoded incorrectly. stopping here\n", i+textOffset, inst)
+				log.Printf("offset 0x%x: warn: encountered instruction '%v', which is most likely decoded incorrectly. stopping here\n", i+textAddr, inst)
 				break
 			}
 
@@ -225,12 +291,15 @@ func recursiveDisassembler(code []byte, obfInst *[]common.ObfuscatedInstruction,
 			}
 
 			// Obfuscate?
-			if obfuscateInstruction(inst) {
-				*obfInst = append(*obfInst, common.ObfuscatedInstruction{
-					Inst:   inst,
-					Offset: i,
-					Binary: code[i : i+uint64(inst.Len)],
-				})
+			if obfuscateInstruction(inst, mode) {
+				if sem, err := semantics(inst); err != nil {
+					log.Printf("offset 0x%x: not obfuscating: %v\n", i+textAddr, err)
+				} else {
+					*obfInst = append(*obfInst, common.ObfuscatedInstruction{
+						Semantics: sem,
+						Addr:      i + textAddr,
+					})
+				}
 			}
 
 			// Don't follow this branch anymore
@@ -266,6 +335,9 @@ func recursiveFollow(inst x86asm.Inst, offset uint64) (target uint64, follow boo
 		x86asm.JP,
 		x86asm.JRCXZ,
 		x86asm.JS,
+		x86asm.LOOP,
+		x86asm.LOOPE,
+		x86asm.LOOPNE,
 		x86asm.CALL:
 		follow = true
 		break
@@ -285,7 +357,7 @@ func recursiveFollow(inst x86asm.Inst, offset uint64) (target uint64, follow boo
 }
 
 // Helper function determining what instructions to obfuscate
-func obfuscateInstruction(inst x86asm.Inst) bool {
+func obfuscateInstruction(inst x86asm.Inst, mode int) bool {
 	switch inst.Op {
 	case x86asm.JA,
 		x86asm.JAE,
@@ -307,8 +379,45 @@ func obfuscateInstruction(inst x86asm.Inst) bool {
 		x86asm.JP,
 		x86asm.JRCXZ,
 		x86asm.JS,
-		x86asm.CALL:
+		x86asm.LOOP,
+		x86asm.LOOPE,
+		x86asm.LOOPNE,
+		x86asm.CALL,
+		x86asm.RET:
 		return true
+	case x86asm.CMOVA,
+		x86asm.CMOVAE,
+		x86asm.CMOVB,
+		x86asm.CMOVBE,
+		x86asm.CMOVE,
+		x86asm.CMOVG,
+		x86asm.CMOVGE,
+		x86asm.CMOVL,
+		x86asm.CMOVLE,
+		x86asm.CMOVNE,
+		x86asm.CMOVNO,
+		x86asm.CMOVNP,
+		x86asm.CMOVNS,
+		x86asm.CMOVO,
+		x86asm.CMOVP,
+		x86asm.CMOVS,
+		x86asm.SETA,
+		x86asm.SETAE,
+		x86asm.SETB,
+		x86asm.SETBE,
+		x86asm.SETE,
+		x86asm.SETG,
+		x86asm.SETGE,
+		x86asm.SETL,
+		x86asm.SETLE,
+		x86asm.SETNE,
+		x86asm.SETNO,
+		x86asm.SETNP,
+		x86asm.SETNS,
+		x86asm.SETO,
+		x86asm.SETP,
+		x86asm.SETS:
+		return mode&DataFlow == DataFlow
 	}
 
 	return false
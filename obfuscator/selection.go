@@ -0,0 +1,83 @@
+package obfuscator
+
+import (
+	"github.com/BlobbyBob/PtraceObfuscator/common"
+	"log"
+	"math/rand"
+	"sort"
+)
+
+// Options refine, which of the candidate instructions are obfuscated
+// The zero value obfuscates all of them.
+type Options struct {
+	// Profile maps the addresses of instructions to the number of hits in a profiled run of the
+	// packed binary (see PTOBF_PROFILE). Instructions without hits are always obfuscated.
+	Profile map[uint64]uint64
+
+	// Budget is the maximum number of traps the obfuscated instructions may cause in the profiled run.
+	// The coldest instructions are obfuscated first, the remaining hot ones are kept. Negative means unlimited.
+	Budget int64
+
+	// Include restricts the obfuscation to instructions in these ranges, unless it is nil.
+	// An empty, but non-nil slice selects no instruction at all.
+	Include []Range
+
+	// Exclude prevents the instructions in these ranges from being obfuscated
+	Exclude []Range
+
+	// Density is the fraction of the eligible instructions that is obfuscated. The instructions are chosen
+	// randomly. Values outside of (0, 1) obfuscate all of them.
+	Density float64
+
+	// Seed of all random decisions, including the random data replacing the instructions
+	Seed int64
+
+	// Traps that may replace the instructions at runtime, chosen randomly per instruction. Only INT3 by default.
+	Traps []common.Trap
+}
+
+// Randomly choose the given fraction of the candidates
+func thinInstructions(candidates []common.ObfuscatedInstruction, density float64, rng *rand.Rand) []common.ObfuscatedInstruction {
+	if density <= 0 || density >= 1 {
+		return candidates
+	}
+	chosen := make([]common.ObfuscatedInstruction, len(candidates))
+	copy(chosen, candidates)
+	rng.Shuffle(len(chosen), func(i, j int) {
+		chosen[i], chosen[j] = chosen[j], chosen[i]
+	})
+	chosen = chosen[:int(density*float64(len(chosen))+0.5)]
+	log.Printf("Choosing %d of %d instructions with a density of %v", len(chosen), len(candidates), density)
+	return chosen
+}
+
+// Select the instructions to obfuscate according to the profile and the budget
+func selectInstructions(candidates []common.ObfuscatedInstruction, options Options) []common.ObfuscatedInstruction {
+	if options.Profile == nil || options.Budget < 0 {
+		return candidates
+	}
+
+	// Prioritize the coldest instructions
+	sorted := make([]common.ObfuscatedInstruction, len(candidates))
+	copy(sorted, candidates)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return options.Profile[sorted[i].Addr] < options.Profile[sorted[j].Addr]
+	})
+
+	traps := uint64(0)
+	selected := sorted[:0]
+	skippedHits := uint64(0)
+	for _, c := range sorted {
+		hits := options.Profile[c.Addr]
+		if traps+hits > uint64(options.Budget) {
+			skippedHits += hits
+			continue
+		}
+		traps += hits
+		selected = append(selected, c)
+	}
+	if skipped := len(candidates) - len(selected); skipped > 0 {
+		log.Printf("Keeping %d hot instructions with %d hits to stay within the budget of %d traps", skipped, skippedHits, options.Budget)
+	}
+	return selected
+}
@@ -0,0 +1,89 @@
+package obfuscator
+
+import (
+	"github.com/BlobbyBob/PtraceObfuscator/common"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func testCandidates(addrs ...uint64) []common.ObfuscatedInstruction {
+	candidates := make([]common.ObfuscatedInstruction, len(addrs))
+	for i, addr := range addrs {
+		candidates[i] = common.ObfuscatedInstruction{Addr: addr}
+	}
+	return candidates
+}
+
+func addrs(instructions []common.ObfuscatedInstruction) []uint64 {
+	result := make([]uint64, len(instructions))
+	for i, inst := range instructions {
+		result[i] = inst.Addr
+	}
+	return result
+}
+
+func TestSelectInstructions(t *testing.T) {
+	profile := map[uint64]uint64{0x1000: 50, 0x1010: 10, 0x1020: 0, 0x1030: 30, 0x1040: 10}
+	tests := []struct {
+		name    string
+		profile map[uint64]uint64
+		budget  int64
+		want    []uint64 // Coldest first
+	}{
+		{"no profile", nil, 0, []uint64{0x1000, 0x1010, 0x1020, 0x1030, 0x1040, 0x1050}},
+		{"unlimited", profile, -1, []uint64{0x1000, 0x1010, 0x1020, 0x1030, 0x1040, 0x1050}},
+		{"zero budget", profile, 0, []uint64{0x1020, 0x1050}},
+		{"ties", profile, 15, []uint64{0x1020, 0x1050, 0x1010}},
+		{"exact budget", profile, 50, []uint64{0x1020, 0x1050, 0x1010, 0x1040, 0x1030}},
+		{"skips hot, keeps colder", profile, 49, []uint64{0x1020, 0x1050, 0x1010, 0x1040}},
+		{"everything", profile, 100, []uint64{0x1020, 0x1050, 0x1010, 0x1040, 0x1030, 0x1000}},
+	}
+	for _, test := range tests {
+		candidates := testCandidates(0x1000, 0x1010, 0x1020, 0x1030, 0x1040, 0x1050)
+		got := selectInstructions(candidates, Options{Profile: test.profile, Budget: test.budget})
+		if !reflect.DeepEqual(addrs(got), test.want) {
+			t.Errorf("%s: selected %#x, want %#x", test.name, addrs(got), test.want)
+		}
+		if !reflect.DeepEqual(candidates, testCandidates(0x1000, 0x1010, 0x1020, 0x1030, 0x1040, 0x1050)) {
+			t.Errorf("%s: candidates modified", test.name)
+		}
+	}
+}
+
+func TestThinInstructions(t *testing.T) {
+	all := make([]uint64, 100)
+	for i := range all {
+		all[i] = 0x1000 + uint64(i)
+	}
+	tests := []struct {
+		density float64
+		want    int
+	}{
+		{0, 100}, {1, 100}, {1.5, 100}, {-1, 100}, {0.3, 30}, {0.005, 1}, {0.004, 0}, {0.999, 100},
+	}
+	for _, test := range tests {
+		got := thinInstructions(testCandidates(all...), test.density, rand.New(rand.NewSource(1)))
+		if len(got) != test.want {
+			t.Errorf("density %v: chose %d instructions, want %d", test.density, len(got), test.want)
+		}
+		seen := make(map[uint64]bool)
+		for _, addr := range addrs(got) {
+			if addr < 0x1000 || addr >= 0x1000+100 || seen[addr] {
+				t.Errorf("density %v: invalid or duplicate choice %#x", test.density, addr)
+			}
+			seen[addr] = true
+		}
+	}
+
+	// The choice only depends on the seed
+	thin := func(seed int64) []uint64 {
+		return addrs(thinInstructions(testCandidates(all...), 0.5, rand.New(rand.NewSource(seed))))
+	}
+	if !reflect.DeepEqual(thin(1), thin(1)) {
+		t.Error("same seed chose different instructions")
+	}
+	if reflect.DeepEqual(thin(1), thin(2)) {
+		t.Error("different seeds chose the same instructions")
+	}
+}
@@ -0,0 +1,157 @@
+package obfuscator
+
+import (
+	"fmt"
+	"github.com/BlobbyBob/PtraceObfuscator/common"
+	"golang.org/x/arch/x86/x86asm"
+)
+
+// Conditional jumps, moves and sets together with the condition they evaluate
+var conditions = map[x86asm.Op]common.Cond{
+	x86asm.JO:  common.CondO,
+	x86asm.JNO: common.CondNO,
+	x86asm.JS:  common.CondS,
+	x86asm.JNS: common.CondNS,
+	x86asm.JE:  common.CondE,
+	x86asm.JNE: common.CondNE,
+	x86asm.JB:  common.CondB,
+	x86asm.JAE: common.CondAE,
+	x86asm.JBE: common.CondBE,
+	x86asm.JA:  common.CondA,
+	x86asm.JL:  common.CondL,
+	x86asm.JGE: common.CondGE,
+	x86asm.JLE: common.CondLE,
+	x86asm.JG:  common.CondG,
+	x86asm.JP:  common.CondP,
+	x86asm.JNP: common.CondNP,
+
+	x86asm.CMOVO:  common.CondO,
+	x86asm.CMOVNO: common.CondNO,
+	x86asm.CMOVS:  common.CondS,
+	x86asm.CMOVNS: common.CondNS,
+	x86asm.CMOVE:  common.CondE,
+	x86asm.CMOVNE: common.CondNE,
+	x86asm.CMOVB:  common.CondB,
+	x86asm.CMOVAE: common.CondAE,
+	x86asm.CMOVBE: common.CondBE,
+	x86asm.CMOVA:  common.CondA,
+	x86asm.CMOVL:  common.CondL,
+	x86asm.CMOVGE: common.CondGE,
+	x86asm.CMOVLE: common.CondLE,
+	x86asm.CMOVG:  common.CondG,
+	x86asm.CMOVP:  common.CondP,
+	x86asm.CMOVNP: common.CondNP,
+
+	x86asm.SETO:  common.CondO,
+	x86asm.SETNO: common.CondNO,
+	x86asm.SETS:  common.CondS,
+	x86asm.SETNS: common.CondNS,
+	x86asm.SETE:  common.CondE,
+	x86asm.SETNE: common.CondNE,
+	x86asm.SETB:  common.CondB,
+	x86asm.SETAE: common.CondAE,
+	x86asm.SETBE: common.CondBE,
+	x86asm.SETA:  common.CondA,
+	x86asm.SETL:  common.CondL,
+	x86asm.SETGE: common.CondGE,
+	x86asm.SETLE: common.CondLE,
+	x86asm.SETG:  common.CondG,
+	x86asm.SETP:  common.CondP,
+	x86asm.SETNP: common.CondNP,
+}
+
+// Translate an instruction selected by obfuscateInstruction into the semantic record performed by the runtime
+func semantics(inst x86asm.Inst) (common.Semantics, error) {
+	s := common.Semantics{Len: uint8(inst.Len), AddrSize: uint8(inst.AddrSize)}
+	switch inst.Op {
+	case x86asm.JMP:
+		s.Kind = common.KindJump
+	case x86asm.CALL:
+		s.Kind = common.KindCall
+	case x86asm.RET:
+		s.Kind = common.KindRet
+	case x86asm.LOOP:
+		s.Kind = common.KindLoop
+	case x86asm.LOOPE:
+		s.Kind, s.Cond = common.KindLoop, common.CondE
+	case x86asm.LOOPNE:
+		s.Kind, s.Cond = common.KindLoop, common.CondNE
+	case x86asm.JCXZ:
+		s.Kind, s.Cond, s.AddrSize = common.KindJump, common.CondCXZ, 16
+	case x86asm.JECXZ:
+		s.Kind, s.Cond, s.AddrSize = common.KindJump, common.CondCXZ, 32
+	case x86asm.JRCXZ:
+		s.Kind, s.Cond, s.AddrSize = common.KindJump, common.CondCXZ, 64
+	default:
+		cond, exists := conditions[inst.Op]
+		if !exists {
+			return s, fmt.Errorf("unsupported instruction %v", inst)
+		}
+		s.Cond = cond
+		switch {
+		case inst.Op >= x86asm.CMOVA && inst.Op <= x86asm.CMOVS:
+			s.Kind = common.KindMove
+		case inst.Op >= x86asm.SETA && inst.Op <= x86asm.SETS:
+			s.Kind = common.KindSet
+		default:
+			s.Kind = common.KindJump
+		}
+	}
+
+	for i := range s.Args {
+		var err error
+		if s.Args[i], err = operand(inst.Args[i], inst); err != nil {
+			return s, fmt.Errorf("unsupported operand of instruction %v: %v", inst, err)
+		}
+	}
+	return s, nil
+}
+
+// Translate an operand
+func operand(arg x86asm.Arg, inst x86asm.Inst) (common.Operand, error) {
+	switch arg := arg.(type) {
+	case nil:
+		return common.Operand{Kind: common.OperandNone}, nil
+	case x86asm.Rel:
+		return common.Operand{Kind: common.OperandRel, Imm: int64(arg)}, nil
+	case x86asm.Imm:
+		return common.Operand{Kind: common.OperandImm, Imm: int64(arg)}, nil
+	case x86asm.Reg:
+		reg, err := register(arg)
+		if err != nil || reg > common.R15 {
+			return common.Operand{}, fmt.Errorf("invalid register %v", arg)
+		}
+		return common.Operand{Kind: common.OperandReg, Reg: reg}, nil
+	case x86asm.Mem:
+		// x86asm zero-extends 32 bit displacements, but they are signed
+		mem := common.Memory{Scale: arg.Scale, Disp: int64(int32(arg.Disp))}
+		var err error
+		if mem.Segment, err = register(arg.Segment); err != nil {
+			return common.Operand{}, err
+		}
+		if mem.Base, err = register(arg.Base); err != nil {
+			return common.Operand{}, err
+		}
+		if mem.Index, err = register(arg.Index); err != nil {
+			return common.Operand{}, err
+		}
+		return common.Operand{Kind: common.OperandMem, Mem: mem, Size: uint8(inst.MemBytes)}, nil
+	}
+	return common.Operand{}, fmt.Errorf("invalid operand %v", arg)
+}
+
+// Translate a register
+// The general purpose, instruction pointer and segment registers are ordered the same way in both packages.
+func register(reg x86asm.Reg) (common.Reg, error) {
+	switch {
+	case reg == 0:
+		return common.RegNone, nil
+	case reg >= x86asm.AL && reg <= x86asm.R15:
+		return common.AL + common.Reg(reg-x86asm.AL), nil
+	case reg >= x86asm.IP && reg <= x86asm.RIP:
+		return common.IP + common.Reg(reg-x86asm.IP), nil
+	case reg >= x86asm.ES && reg <= x86asm.GS:
+		return common.ES + common.Reg(reg-x86asm.ES), nil
+	}
+	return common.RegNone, fmt.Errorf("invalid register %v", reg)
+}
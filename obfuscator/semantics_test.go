@@ -0,0 +1,71 @@
+package obfuscator
+
+import (
+	"github.com/BlobbyBob/PtraceObfuscator/common"
+	"golang.org/x/arch/x86/x86asm"
+	"testing"
+)
+
+func TestSemantics(t *testing.T) {
+	mem := func(size uint8, m common.Memory) common.Operand {
+		return common.Operand{Kind: common.OperandMem, Mem: m, Size: size}
+	}
+	reg := func(r common.Reg) common.Operand {
+		return common.Operand{Kind: common.OperandReg, Reg: r}
+	}
+	tests := []struct {
+		name string
+		code []byte
+		want common.Semantics
+	}{
+		{"rel8", []byte{0xeb, 0xfe}, common.Semantics{Kind: common.KindJump, Len: 2, AddrSize: 64,
+			Args: [2]common.Operand{{Kind: common.OperandRel, Imm: -2}}}},
+		{"negative disp8", []byte{0xff, 0x53, 0xf8}, common.Semantics{Kind: common.KindCall, Len: 3, AddrSize: 64,
+			Args: [2]common.Operand{mem(8, common.Memory{Base: common.RBX, Disp: -8})}}},
+		{"negative disp32", []byte{0xff, 0x93, 0x00, 0xff, 0xff, 0xff}, common.Semantics{Kind: common.KindCall, Len: 6, AddrSize: 64,
+			Args: [2]common.Operand{mem(8, common.Memory{Base: common.RBX, Disp: -0x100})}}},
+		{"no base", []byte{0xff, 0x24, 0xcd, 0x00, 0x10, 0x00, 0x00}, common.Semantics{Kind: common.KindJump, Len: 7, AddrSize: 64,
+			Args: [2]common.Operand{mem(8, common.Memory{Index: common.RCX, Scale: 8, Disp: 0x1000})}}},
+		{"address-size override", []byte{0x67, 0xff, 0x50, 0x10}, common.Semantics{Kind: common.KindCall, Len: 4, AddrSize: 32,
+			Args: [2]common.Operand{mem(8, common.Memory{Base: common.EAX, Disp: 0x10})}}},
+		{"address-size override with index", []byte{0x67, 0xff, 0x64, 0x8b, 0xfc}, common.Semantics{Kind: common.KindJump, Len: 5, AddrSize: 32,
+			Args: [2]common.Operand{mem(8, common.Memory{Base: common.EBX, Index: common.ECX, Scale: 4, Disp: -4})}}},
+		{"rip-relative", []byte{0xff, 0x15, 0xf0, 0xff, 0xff, 0xff}, common.Semantics{Kind: common.KindCall, Len: 6, AddrSize: 64,
+			Args: [2]common.Operand{mem(8, common.Memory{Base: common.RIP, Disp: -0x10})}}},
+		{"fs", []byte{0x64, 0xff, 0x14, 0x25, 0xf8, 0xff, 0xff, 0xff}, common.Semantics{Kind: common.KindCall, Len: 8, AddrSize: 64,
+			Args: [2]common.Operand{mem(8, common.Memory{Segment: common.FS, Scale: 1, Disp: -8})}}},
+		{"gs", []byte{0x65, 0x48, 0x0f, 0x44, 0x04, 0x25, 0x28, 0x00, 0x00, 0x00}, common.Semantics{Kind: common.KindMove, Cond: common.CondE, Len: 10, AddrSize: 64,
+			Args: [2]common.Operand{reg(common.RAX), mem(8, common.Memory{Segment: common.GS, Scale: 1, Disp: 0x28})}}},
+		{"32 bit registers", []byte{0x0f, 0x4c, 0xc1}, common.Semantics{Kind: common.KindMove, Cond: common.CondL, Len: 3, AddrSize: 64,
+			Args: [2]common.Operand{reg(common.EAX), reg(common.ECX)}}},
+		{"set byte", []byte{0x0f, 0x94, 0x45, 0xf0}, common.Semantics{Kind: common.KindSet, Cond: common.CondE, Len: 4, AddrSize: 64,
+			Args: [2]common.Operand{mem(1, common.Memory{Base: common.RBP, Disp: -0x10})}}},
+		{"jecxz", []byte{0x67, 0xe3, 0x10}, common.Semantics{Kind: common.KindJump, Cond: common.CondCXZ, Len: 3, AddrSize: 32,
+			Args: [2]common.Operand{{Kind: common.OperandRel, Imm: 0x10}}}},
+	}
+	for _, test := range tests {
+		inst, err := x86asm.Decode(test.code, 64)
+		if err != nil {
+			t.Fatalf("%s: can't decode % x: %v", test.name, test.code, err)
+		}
+		got, err := semantics(inst)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: %v = %#v, want %#v", test.name, inst, got, test.want)
+		}
+	}
+}
+
+func TestSemanticsUnsupported(t *testing.T) {
+	// MOV isn't obfuscated
+	inst, err := x86asm.Decode([]byte{0x48, 0x89, 0xc3}, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := semantics(inst); err == nil {
+		t.Errorf("%v: expected error", inst)
+	}
+}
@@ -0,0 +1,28 @@
+package obfuscator
+
+import (
+	"github.com/BlobbyBob/PtraceObfuscator/common"
+	"math/rand"
+)
+
+// Randomly choose one of the traps for each instruction
+// A trap must not be longer than the instruction it replaces. If none of the traps fits, INT3 is used.
+func chooseTraps(instructions []common.ObfuscatedInstruction, traps []common.Trap, rng *rand.Rand) {
+	if len(traps) == 0 {
+		traps = []common.Trap{common.TrapInt3}
+	}
+	fitting := make([]common.Trap, 0, len(traps))
+	for i := range instructions {
+		fitting = fitting[:0]
+		for _, trap := range traps {
+			if trap.Len() <= instructions[i].Semantics.Len {
+				fitting = append(fitting, trap)
+			}
+		}
+		if len(fitting) == 0 {
+			instructions[i].Trap = common.TrapInt3
+			continue
+		}
+		instructions[i].Trap = fitting[rng.Intn(len(fitting))]
+	}
+}
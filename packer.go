@@ -1,25 +1,56 @@
 package main
 
 import (
+	"bufio"
+	"debug/elf"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/BlobbyBob/PtraceObfuscator/common"
 	"github.com/BlobbyBob/PtraceObfuscator/obfuscator"
+	"github.com/BlobbyBob/PtraceObfuscator/payload"
+	"github.com/BlobbyBob/PtraceObfuscator/profile"
+	"github.com/BlobbyBob/PtraceObfuscator/trace"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
 )
 
 // Packer
 //
-// The packer produces a single standalone obfuscated binary by compiling the runtime
-// with the obfuscated binary and the metadata integrated as binary buffers.
+// The packer produces a single standalone obfuscated binary by appending the obfuscated binary
+// and the metadata as payload to the prebuilt runtime stub.
+// With the subcommand trace, it renders a trace recorded by a packed binary instead.
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "trace" {
+		renderTrace(os.Args[2:])
+		return
+	}
+
 	nop := flag.Bool("nop", false, "Use NOPs instead of random data")
+	dataFlow := flag.Bool("dataflow", false, "Also obfuscate conditional moves and sets")
 	var file string
-	flag.StringVar(&file, "f", "", "ELF file. Existing files with suffixes .obf, .strip and .packed in directory of the file will be overwritten")
+	flag.StringVar(&file, "f", "", "ELF file. Existing files with suffixes .obf, .strip, .meta.json and .packed in directory of the file will be overwritten")
+	var libraries stringList
+	flag.Var(&libraries, "lib", "Shared library loaded by the ELF file, which is obfuscated as well. Can be given multiple times")
+	stub := flag.String("stub", defaultStub(), "Prebuilt runtime stub")
+	debugJson := flag.Bool("json", false, "Additionally export the metadata as JSON into a file with suffix .meta.json for debugging")
+	profileFile := flag.String("profile", "", "Profile written by the packed binary with PTOBF_PROFILE. Hot instructions exceeding the budget aren't obfuscated")
+	budget := flag.Int64("budget", -1, "Maximum number of traps caused by obfuscated instructions in the profiled run, required with -profile")
+	var include, exclude, includeAddr, excludeAddr stringList
+	flag.Var(&include, "include", "Only obfuscate functions whose symbol names match the regular expression. Can be given multiple times")
+	flag.Var(&exclude, "exclude", "Don't obfuscate functions whose symbol names match the regular expression. Can be given multiple times")
+	flag.Var(&includeAddr, "include-addr", "Only obfuscate the address ranges [module:]start[-end],... Can be given multiple times")
+	flag.Var(&excludeAddr, "exclude-addr", "Don't obfuscate the address ranges [module:]start[-end],... Can be given multiple times")
+	density := flag.Float64("density", 1, "Fraction of the eligible instructions to obfuscate, chosen randomly")
+	seed := flag.Int64("seed", 0, "Seed for all random decisions, which makes the output reproducible. By default, a random seed is chosen and logged")
+	trapList := flag.String("traps", "int3", "Comma-separated traps chosen randomly per instruction: int3, int1, ud2, hlt, priv, invalid, mem or all")
 	flag.Parse()
 
 	if file == "" {
@@ -27,70 +58,284 @@ func main() {
 		os.Exit(1)
 	}
 
-	log.Print("Obfuscating ", file)
 	repl := 0
 	if !*nop {
 		repl = obfuscator.Rand
 	}
+	if *dataFlow {
+		repl |= obfuscator.DataFlow
+	}
 
-	execute("strip", "-s", "-o", file+".strip", file)
-	elf, metadata, err := obfuscator.Obfuscate(file+".strip", obfuscator.Linear|repl)
+	runtime, err := ioutil.ReadFile(*stub)
 	if err != nil {
-		log.Fatal(err)
+		fmt.Println("can't read runtime stub:", err)
+		os.Exit(1)
 	}
 
-	_ = ioutil.WriteFile(file+".obf", elf, 0644)
+	prof := profile.New()
+	if *profileFile != "" {
+		if *budget < 0 {
+			fmt.Println("Missing argument: -profile requires a -budget")
+			os.Exit(1)
+		}
+		if prof, err = profile.Read(*profileFile); err != nil {
+			fmt.Println("can't read profile:", err)
+			os.Exit(1)
+		}
+	}
+	traps, err := common.ParseTraps(*trapList)
+	if err != nil {
+		fmt.Println("invalid traps:", err)
+		os.Exit(1)
+	}
+
+	var filter filters
+	if err := filter.parse(include, exclude, includeAddr, excludeAddr); err != nil {
+		fmt.Println("invalid filter:", err)
+		os.Exit(1)
+	}
+	if *density <= 0 || *density > 1 {
+		fmt.Println("invalid density: must be greater than 0 and at most 1")
+		os.Exit(1)
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+		log.Print("Using seed ", *seed)
+	}
+	// The salt and nonce of the sealed metadata are derived from the seed as well, so the output can be replayed
+	random := rand.New(rand.NewSource(*seed))
+	options := func(file, name string) obfuscator.Options {
+		options := obfuscator.Options{Budget: -1, Density: *density, Seed: *seed, Traps: traps}
+		if *profileFile != "" {
+			options.Profile, options.Budget = prof.Modules[name], *budget
+		}
+		if err := filter.apply(&options, file, name); err != nil {
+			log.Fatal(err)
+		}
+		return options
+	}
+
+	name := filepath.Base(file)
+	elf, metadata := obfuscate(file, repl, options(file, name))
+	metadata.Name = name
+	debug := []*common.Metadata{metadata}
+	modules := []common.ExportMetadata{common.Export(metadata)}
+
+	libs := make([][]byte, 0, len(libraries))
+	for _, lib := range libraries {
+		libName := soname(lib)
+		obfLib, libMetadata := obfuscate(lib, repl, options(lib, libName))
+		libMetadata.Name = libName
+		debug = append(debug, libMetadata)
+		modules = append(modules, common.Export(libMetadata))
+		libs = append(libs, obfLib)
+	}
+
+	if *debugJson {
+		// The debug export contains the decoded semantics
+		metadataJson, err := json.Marshal(debug)
+		if err != nil {
+			log.Fatal(err)
+		}
+		_ = ioutil.WriteFile(file+".meta.json", metadataJson, 0644)
+	}
 
-	metadataJson, err := json.Marshal(common.ExportObfuscatedInstructions(*metadata))
+	sealed, err := payload.Seal(common.EncodeMetadata(modules), elf, libs, random)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	writeSourceFile(elf, "bin/obf.go", "Obf")
-	writeSourceFile(metadataJson, "bin/meta.go", "Meta")
-
 	log.Print("Packing binary")
-	execute("go", "build", "-o", file+".packed", "runtime.go")
-	log.Print("Stripping symbols")
-	execute("strip", "-s", file+".packed")
+	out, err := os.OpenFile(file+".packed", os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0755)
+	if err != nil {
+		fmt.Println("can't open output file:", err)
+		os.Exit(1)
+	}
+	p := &payload.Payload{Metadata: sealed, Binary: elf, Libraries: libs}
+	if err := payload.Write(out, runtime, p); err != nil {
+		fmt.Println("can't write to file:", err)
+		os.Exit(1)
+	}
+	_ = out.Close()
 }
 
-// A simple utility for executing a program on the command line
-func execute(name string, arg ...string) {
-	cmd := exec.Command(name, arg...)
-	b, err := cmd.CombinedOutput()
-	fmt.Println(string(b))
-	if ee, isEE := err.(*exec.ExitError); isEE {
-		if ee.ExitCode() != 0 {
-			os.Exit(ee.ExitCode())
+// Render a trace written by the packed binary with PTOBF_TRACE as timeline or histogram
+func renderTrace(args []string) {
+	flags := flag.NewFlagSet("trace", flag.ExitOnError)
+	flags.Usage = func() {
+		_, _ = fmt.Fprintf(flags.Output(), "Usage: %s trace [options] file\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	histogram := flags.Bool("histogram", false, "Show the number of hits per obfuscated instruction instead of the timeline")
+	limit := flags.Int("n", 0, "Maximum number of events or instructions to show, 0 is unlimited")
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	t, err := trace.Read(flags.Arg(0))
+	if err != nil {
+		fmt.Println("can't read trace:", err)
+		os.Exit(1)
+	}
+	out := bufio.NewWriter(os.Stdout)
+	if *histogram {
+		trace.Histogram(out, t, *limit)
+	} else {
+		trace.Timeline(out, t, *limit)
+	}
+	_ = out.Flush()
+}
+
+// The runtime stub is expected next to the packer by default
+func defaultStub() string {
+	packer, err := os.Executable()
+	if err != nil {
+		return "stub"
+	}
+	return filepath.Join(filepath.Dir(packer), "stub")
+}
+
+// A command line flag, which can be given multiple times
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// The function and address filters given on the command line
+type filters struct {
+	include, exclude         []*regexp.Regexp
+	includeAddr, excludeAddr []profile.Range
+}
+
+func (f *filters) parse(include, exclude, includeAddr, excludeAddr []string) error {
+	for _, pattern := range include {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return err
+		}
+		f.include = append(f.include, re)
+	}
+	for _, pattern := range exclude {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return err
 		}
+		f.exclude = append(f.exclude, re)
 	}
+	for _, list := range includeAddr {
+		ranges, err := profile.ParseAllowList(list)
+		if err != nil {
+			return err
+		}
+		f.includeAddr = append(f.includeAddr, ranges...)
+	}
+	for _, list := range excludeAddr {
+		ranges, err := profile.ParseAllowList(list)
+		if err != nil {
+			return err
+		}
+		f.excludeAddr = append(f.excludeAddr, ranges...)
+	}
+	return nil
 }
 
-// Write a binary buffer into a Go source file
-func writeSourceFile(input []byte, output, varname string) {
-	out, err := os.OpenFile(output, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0644)
+// Resolve the filters into the address ranges of a module
+// The symbols are read from the unstripped file.
+func (f *filters) apply(options *obfuscator.Options, file, name string) error {
+	if len(f.include) > 0 || len(f.includeAddr) > 0 {
+		functions, err := obfuscator.FunctionRanges(file, f.include)
+		if err != nil {
+			return err
+		}
+		// Non-nil even if nothing matches, so the module isn't obfuscated at all
+		options.Include = append(moduleRanges(f.includeAddr, name), functions...)
+		if len(f.include) > 0 && len(functions) == 0 {
+			log.Printf("No function of %v matches the include filters", file)
+		}
+	}
+	functions, err := obfuscator.FunctionRanges(file, f.exclude)
 	if err != nil {
-		fmt.Println("can't open output file:", err)
-		os.Exit(1)
+		return err
 	}
+	options.Exclude = append(functions, moduleRanges(f.excludeAddr, name)...)
+	return nil
+}
 
-	if _, err := out.WriteString("package bin; var " + varname + " = []byte{"); err != nil {
-		fmt.Println("can't write to file:", err)
-		os.Exit(1)
+// Select the address ranges that apply to a module
+func moduleRanges(ranges []profile.Range, name string) []obfuscator.Range {
+	selected := make([]obfuscator.Range, 0)
+	for _, r := range ranges {
+		if r.Module == "" || r.Module == name {
+			selected = append(selected, obfuscator.Range{Start: r.Start, End: r.End})
+		}
 	}
+	return selected
+}
 
-	for _, b := range input {
-		if _, err := out.WriteString(fmt.Sprintf("%d,", b)); err != nil {
-			fmt.Println("can't write to file:", err)
-			os.Exit(1)
+// Strip and obfuscate a binary or shared library
+// Existing files with suffixes .obf and .strip in the directory of the file will be overwritten
+func obfuscate(file string, mode int, options obfuscator.Options) ([]byte, *common.Metadata) {
+	log.Print("Obfuscating ", file)
+	if hasSections(file) {
+		execute("strip", "-s", "-o", file+".strip", file)
+	} else {
+		// strip refuses to process binaries without section headers, but there is nothing left to strip anyway
+		contents, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file+".strip", contents, 0755); err != nil {
+			log.Fatal(err)
 		}
 	}
+	elf, metadata, err := obfuscator.Obfuscate(file+".strip", obfuscator.Linear|mode, options)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	if _, err := out.WriteString("}"); err != nil {
-		fmt.Println("can't write to file:", err)
-		os.Exit(1)
+	_ = ioutil.WriteFile(file+".obf", elf, 0644)
+	return elf, metadata
+}
+
+// Determine the name the dynamic loader uses for a shared library
+func soname(file string) string {
+	f, err := elf.Open(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	if names, err := f.DynString(elf.DT_SONAME); err == nil && len(names) > 0 {
+		return names[0]
 	}
+	return filepath.Base(file)
+}
 
-	_ = out.Close()
+// Check whether an ELF file contains section headers
+func hasSections(file string) bool {
+	f, err := elf.Open(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	return len(f.Sections) > 0
+}
+
+// A simple utility for executing a program on the command line
+func execute(name string, arg ...string) {
+	cmd := exec.Command(name, arg...)
+	b, err := cmd.CombinedOutput()
+	fmt.Println(string(b))
+	if ee, isEE := err.(*exec.ExitError); isEE {
+		if ee.ExitCode() != 0 {
+			os.Exit(ee.ExitCode())
+		}
+	}
 }
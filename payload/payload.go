@@ -0,0 +1,113 @@
+package payload
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+// The payload is appended to the prebuilt runtime stub. It consists of the blobs, followed by a trailer:
+//
+//	blob 0 | blob 1 | ... | blob n-1 | length 0 | ... | length n-1 | n | magic
+//
+// The lengths are 64 bit and the count is 32 bit, all little endian. The trailer is located
+// by the magic at the very end of the file, so the stub can be any executable.
+var magic = [8]byte{'P', 'T', 'O', 'B', 'F', 'P', 'L', 'D'}
+
+const footerSize = 4 + len(magic)
+
+// ErrNoPayload is returned, if a file doesn't end with a payload
+var ErrNoPayload = errors.New("no payload appended")
+
+// Payload contains everything the runtime needs to execute an obfuscated binary
+type Payload struct {
+	Metadata  []byte   // Serialized metadata of all modules, sealed with Seal
+	Binary    []byte   // The obfuscated binary
+	Libraries [][]byte // The obfuscated shared libraries in the order of the metadata
+}
+
+// Write the stub followed by the payload to w
+func Write(w io.Writer, stub []byte, p *Payload) error {
+	blobs := append([][]byte{p.Metadata, p.Binary}, p.Libraries...)
+
+	if _, err := w.Write(stub); err != nil {
+		return err
+	}
+	for _, blob := range blobs {
+		if _, err := w.Write(blob); err != nil {
+			return err
+		}
+	}
+
+	trailer := make([]byte, 8*len(blobs)+footerSize)
+	for i, blob := range blobs {
+		binary.LittleEndian.PutUint64(trailer[8*i:], uint64(len(blob)))
+	}
+	binary.LittleEndian.PutUint32(trailer[8*len(blobs):], uint32(len(blobs)))
+	copy(trailer[8*len(blobs)+4:], magic[:])
+	_, err := w.Write(trailer)
+	return err
+}
+
+// Read the payload appended to a file
+func Read(file string) (*Payload, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	end := info.Size()
+
+	// Footer
+	if end < int64(footerSize) {
+		return nil, ErrNoPayload
+	}
+	footer := make([]byte, footerSize)
+	if _, err := f.ReadAt(footer, end-int64(footerSize)); err != nil {
+		return nil, err
+	}
+	if string(footer[4:]) != string(magic[:]) {
+		return nil, ErrNoPayload
+	}
+	count := int64(binary.LittleEndian.Uint32(footer))
+	if count < 2 || 8*count > end-int64(footerSize) {
+		return nil, errors.New("invalid payload trailer")
+	}
+
+	// Lengths
+	end -= int64(footerSize) + 8*count
+	lengths := make([]byte, 8*count)
+	if _, err := f.ReadAt(lengths, end); err != nil {
+		return nil, err
+	}
+	start := end
+	for i := int64(0); i < count; i++ {
+		length := binary.LittleEndian.Uint64(lengths[8*i:])
+		if length > uint64(start) {
+			return nil, errors.New("invalid payload trailer")
+		}
+		start -= int64(length)
+	}
+
+	// Blobs
+	blobs := make([][]byte, count)
+	for i := range blobs {
+		blobs[i] = make([]byte, binary.LittleEndian.Uint64(lengths[8*i:]))
+		if _, err := f.ReadAt(blobs[i], start); err != nil {
+			return nil, err
+		}
+		start += int64(len(blobs[i]))
+	}
+
+	return &Payload{
+		Metadata:  blobs[0],
+		Binary:    blobs[1],
+		Libraries: blobs[2:],
+	}, nil
+}
@@ -0,0 +1,79 @@
+package payload
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var testPayload = &Payload{
+	Metadata:  []byte("metadata"),
+	Binary:    []byte("\x7fELF binary"),
+	Libraries: [][]byte{[]byte("libfoo"), {}, []byte("libbar")},
+}
+
+func writePayload(t *testing.T, data []byte) string {
+	file := filepath.Join(t.TempDir(), "packed")
+	if err := ioutil.WriteFile(file, data, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, stub := range [][]byte{{}, []byte("\x7fELF stub")} {
+		var buf bytes.Buffer
+		if err := Write(&buf, stub, testPayload); err != nil {
+			t.Fatal(err)
+		}
+		p, err := Read(writePayload(t, buf.Bytes()))
+		if err != nil {
+			t.Fatalf("stub %q: %v", stub, err)
+		}
+		if !reflect.DeepEqual(p, testPayload) {
+			t.Errorf("stub %q: read %+v, want %+v", stub, p, testPayload)
+		}
+	}
+}
+
+func TestReadInvalid(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Write(&buf, []byte("stub"), testPayload); err != nil {
+		t.Fatal(err)
+	}
+	valid := buf.Bytes()
+	modify := func(i int, value uint64, size int) []byte {
+		data := append([]byte(nil), valid...)
+		if size == 4 {
+			binary.LittleEndian.PutUint32(data[i:], uint32(value))
+		} else {
+			binary.LittleEndian.PutUint64(data[i:], value)
+		}
+		return data
+	}
+	count := len(valid) - footerSize
+	lengths := count - 8*5
+
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"empty", []byte{}, ErrNoPayload},
+		{"stub only", []byte("stub"), ErrNoPayload},
+		{"magic", valid[:len(valid)-1], ErrNoPayload},
+		{"count too small", modify(count, 1, 4), nil},
+		{"count too large", modify(count, 0xffffffff, 4), nil},
+		{"length too large", modify(lengths, uint64(len(valid)), 8), nil},
+		{"length overflow", modify(lengths, 1<<63, 8), nil},
+	}
+	for _, test := range tests {
+		p, err := Read(writePayload(t, test.data))
+		if err == nil || test.err != nil && err != test.err {
+			t.Errorf("%s: read %+v, %v", test.name, p, err)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package payload
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+)
+
+// The metadata is encrypted and authenticated with AES-256-GCM:
+//
+//	version | salt | nonce | ciphertext and tag
+//
+// The key is derived from a secret shared by the packer and the runtime, a salt chosen at
+// pack time, the obfuscated binary and the obfuscated libraries. This way, the metadata can only
+// be decrypted together with the binary and libraries it belongs to and modifying any of them is detected.
+const sealVersion = 2
+
+const saltSize = 16
+
+// The shared secret is split into two shares, so it doesn't appear in the runtime as a whole
+var secretShares = [2][sha256.Size]byte{
+	{0xdc, 0xb8, 0x45, 0xdb, 0x1a, 0x18, 0x3f, 0x62, 0xe4, 0xd4, 0xa5, 0xaa, 0x78, 0x79, 0x41, 0x06,
+		0xe3, 0x66, 0x08, 0x82, 0xe0, 0x53, 0xeb, 0x9c, 0x87, 0x01, 0x56, 0x01, 0x02, 0xbb, 0x3b, 0x2e},
+	{0xa6, 0x7b, 0x53, 0xd7, 0xb9, 0x39, 0xe1, 0x3c, 0x9d, 0xe3, 0x57, 0xb1, 0xd1, 0x4e, 0xa2, 0x71,
+		0xe3, 0x85, 0x7b, 0xf4, 0xae, 0x24, 0x44, 0x73, 0xd1, 0x50, 0x0d, 0xe6, 0xf4, 0x74, 0xef, 0x60},
+}
+
+// ErrCorrupted is returned, if sealed metadata can't be authenticated
+var ErrCorrupted = errors.New("metadata is corrupted or doesn't belong to the binary")
+
+// Seal encrypts and authenticates the metadata of a binary and its libraries
+// Like in SIV modes, the salt and the nonce are derived from a key read from random, the metadata and all blobs.
+// Thus, a seeded source makes the output reproducible, while different inputs never reuse a nonce.
+func Seal(metadata, binary []byte, libraries [][]byte, random io.Reader) ([]byte, error) {
+	key := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(random, key); err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, key)
+	writeBlob(mac, metadata)
+	writeBlob(mac, binary)
+	for _, lib := range libraries {
+		writeBlob(mac, lib)
+	}
+	iv := mac.Sum(nil)
+
+	salt := iv[:saltSize]
+	aead, err := newAEAD(salt, binary, libraries)
+	if err != nil {
+		return nil, err
+	}
+	nonce := iv[saltSize : saltSize+aead.NonceSize()]
+
+	sealed := append([]byte{sealVersion}, salt...)
+	sealed = append(sealed, nonce...)
+	return aead.Seal(sealed, nonce, metadata, sealed[:1]), nil
+}
+
+// Open decrypts sealed metadata and verifies that it belongs to the binary and its libraries
+func Open(sealed, binary []byte, libraries [][]byte) ([]byte, error) {
+	if len(sealed) < 1+saltSize {
+		return nil, ErrCorrupted
+	}
+	if sealed[0] != sealVersion {
+		return nil, errors.New("unsupported metadata version")
+	}
+	aead, err := newAEAD(sealed[1:1+saltSize], binary, libraries)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < 1+saltSize+aead.NonceSize() {
+		return nil, ErrCorrupted
+	}
+	nonce := sealed[1+saltSize : 1+saltSize+aead.NonceSize()]
+	metadata, err := aead.Open(nil, nonce, sealed[1+saltSize+aead.NonceSize():], sealed[:1])
+	if err != nil {
+		return nil, ErrCorrupted
+	}
+	return metadata, nil
+}
+
+// Hash a blob prefixed with its length, so the boundaries between the blobs are unambiguous
+func writeBlob(h hash.Hash, blob []byte) {
+	var length [8]byte
+	binary.LittleEndian.PutUint64(length[:], uint64(len(blob)))
+	h.Write(length[:])
+	h.Write(blob)
+}
+
+// Derive the key and set up the cipher
+func newAEAD(salt, binary []byte, libraries [][]byte) (cipher.AEAD, error) {
+	h := sha256.New()
+	for i := range secretShares[0] {
+		h.Write([]byte{secretShares[0][i] ^ secretShares[1][i]})
+	}
+	h.Write(salt)
+	writeBlob(h, binary)
+	for _, lib := range libraries {
+		writeBlob(h, lib)
+	}
+
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,80 @@
+package payload
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestSealNonce(t *testing.T) {
+	seal := func(metadata, binary []byte, libraries ...[]byte) []byte {
+		sealed, err := Seal(metadata, binary, libraries, rand.New(rand.NewSource(42)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sealed
+	}
+	header := 1 + saltSize + 12
+
+	sealed := seal([]byte("metadata"), []byte("binary"), []byte("lib"))
+	if !bytes.Equal(sealed, seal([]byte("metadata"), []byte("binary"), []byte("lib"))) {
+		t.Error("sealing the same inputs with the same seed isn't reproducible")
+	}
+
+	tests := map[string][]byte{
+		"metadata":   seal([]byte("metadata2"), []byte("binary"), []byte("lib")),
+		"binary":     seal([]byte("metadata"), []byte("binary2"), []byte("lib")),
+		"library":    seal([]byte("metadata"), []byte("binary"), []byte("lib2")),
+		"no library": seal([]byte("metadata"), []byte("binary")),
+		"boundary":   seal([]byte("metadatab"), []byte("inary"), []byte("lib")),
+	}
+	for name, other := range tests {
+		if bytes.Equal(sealed[:header], other[:header]) {
+			t.Errorf("%s: salt and nonce reused", name)
+		}
+	}
+}
+
+func TestOpenTampered(t *testing.T) {
+	metadata, binary, libraries := []byte("metadata"), []byte("binary"), [][]byte{[]byte("lib1"), []byte("lib2")}
+	sealed, err := Seal(metadata, binary, libraries, rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := Open(sealed, binary, libraries); err != nil || !bytes.Equal(got, metadata) {
+		t.Fatalf("opened as %q, %v", got, err)
+	}
+
+	modify := func(data []byte, i int) []byte {
+		data = append([]byte(nil), data...)
+		data[i] ^= 1
+		return data
+	}
+	tests := []struct {
+		name      string
+		sealed    []byte
+		binary    []byte
+		libraries [][]byte
+	}{
+		{"empty", nil, binary, libraries},
+		{"truncated header", sealed[:1+saltSize], binary, libraries},
+		{"truncated", sealed[:len(sealed)-1], binary, libraries},
+		{"salt", modify(sealed, 1), binary, libraries},
+		{"nonce", modify(sealed, 1+saltSize), binary, libraries},
+		{"ciphertext", modify(sealed, len(sealed)-1), binary, libraries},
+		{"binary", sealed, modify(binary, 0), libraries},
+		{"library", sealed, binary, [][]byte{libraries[0], modify(libraries[1], 3)}},
+		{"missing library", sealed, binary, libraries[:1]},
+		{"swapped libraries", sealed, binary, [][]byte{libraries[1], libraries[0]}},
+		{"moved boundary", sealed, []byte("binaryl"), [][]byte{[]byte("ib1"), libraries[1]}},
+	}
+	for _, test := range tests {
+		if got, err := Open(test.sealed, test.binary, test.libraries); err != ErrCorrupted {
+			t.Errorf("%s: opened as %q, %v", test.name, got, err)
+		}
+	}
+
+	if got, err := Open(modify(sealed, 0), binary, libraries); err == nil {
+		t.Errorf("version: opened as %q", got)
+	}
+}
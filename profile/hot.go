@@ -0,0 +1,139 @@
+package profile
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Policy decides which hot sites are restored to their original instruction
+// Every hit of an obfuscated instruction costs several context switches, so restoring the hottest
+// ones trades obfuscation for speed.
+type Policy struct {
+	Threshold uint64  // Number of hits after which a site is restored, 0 disables restoring
+	Budget    int     // Maximum number of restored sites, 0 means unlimited
+	Allow     []Range // Sites that may be restored, all if empty
+}
+
+// Range of addresses in a module, an empty module name matches all modules
+type Range struct {
+	Module     string
+	Start, End uint64 // End is exclusive
+}
+
+// ParseAllowList parses a comma-separated list of address ranges
+// Each entry has the form [module:]start[-end] with hexadecimal addresses, e.g. "libfoo.so.1:0x1000-0x2000".
+func ParseAllowList(list string) ([]Range, error) {
+	var ranges []Range
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		var r Range
+		if i := strings.LastIndex(entry, ":"); i >= 0 {
+			r.Module, entry = entry[:i], entry[i+1:]
+		}
+		bounds := strings.SplitN(entry, "-", 2)
+		var err error
+		if r.Start, err = strconv.ParseUint(bounds[0], 0, 64); err != nil {
+			return nil, fmt.Errorf("invalid address range %q", entry)
+		}
+		r.End = r.Start + 1
+		if len(bounds) == 2 {
+			if r.End, err = strconv.ParseUint(bounds[1], 0, 64); err != nil || r.End <= r.Start {
+				return nil, fmt.Errorf("invalid address range %q", entry)
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+// Allowed checks whether a site may be restored
+func (p *Policy) Allowed(site Site) bool {
+	if len(p.Allow) == 0 {
+		return true
+	}
+	for _, r := range p.Allow {
+		if (r.Module == "" || r.Module == site.Module) && site.Addr >= r.Start && site.Addr < r.End {
+			return true
+		}
+	}
+	return false
+}
+
+// Hot keeps track of the restored sites according to a policy
+// The number of hits of a restored site is frozen, as it doesn't trap anymore. If the budget is exhausted,
+// a site that becomes at least twice as hot as the coldest restored site takes its place.
+type Hot struct {
+	Policy
+	restored  map[Site]uint64 // Hits at the time of restoring
+	evictions int
+}
+
+// NewHot creates the state for a policy
+func NewHot(policy Policy) *Hot {
+	return &Hot{Policy: policy, restored: make(map[Site]uint64)}
+}
+
+// Restored checks whether a site has been restored
+func (h *Hot) Restored(site Site) bool {
+	_, restored := h.restored[site]
+	return restored
+}
+
+// Decide whether an obfuscated site with the given number of hits is restored
+// If another site needs to be obfuscated again in exchange, it is returned as well.
+func (h *Hot) Decide(site Site, hits uint64) (bool, *Site) {
+	if h.Threshold == 0 || hits < h.Threshold || h.Restored(site) || !h.Allowed(site) {
+		return false, nil
+	}
+	if h.Budget == 0 || len(h.restored) < h.Budget {
+		h.restored[site] = hits
+		return true, nil
+	}
+
+	// Exchange the coldest restored site, if the site got at least twice as hot. Otherwise
+	// sites with similar numbers of hits would be exchanged all the time.
+	var coldest *Site
+	for s, restoredHits := range h.restored {
+		if coldest == nil || restoredHits < h.restored[*coldest] {
+			s := s
+			coldest = &s
+		}
+	}
+	if hits < 2*h.restored[*coldest] {
+		return false, nil
+	}
+	delete(h.restored, *coldest)
+	h.restored[site] = hits
+	h.evictions++
+	return true, coldest
+}
+
+// Report describes the trade-off between obfuscation and speed made by the policy
+func (h *Hot) Report(w io.Writer, p *Profile, sites int) {
+	var restoredHits uint64
+	restored := make([]Site, 0, len(h.restored))
+	for site, hits := range h.restored {
+		restored = append(restored, site)
+		restoredHits += hits
+	}
+	sort.Slice(restored, func(i, j int) bool {
+		return h.restored[restored[i]] > h.restored[restored[j]]
+	})
+	var total uint64
+	for module := range p.Modules {
+		total += p.Total(module)
+	}
+
+	_, _ = fmt.Fprintf(w, "Hot-branch restoration: threshold %d, budget %d, allow-list %d ranges\n", h.Threshold, h.Budget, len(h.Allow))
+	_, _ = fmt.Fprintf(w, "Restored %d of %d obfuscated sites (%d exchanged)\n", len(restored), sites, h.evictions)
+	_, _ = fmt.Fprintf(w, "Handled %d traps, %d of them at sites before restoring them\n", total, restoredHits)
+	for _, site := range restored {
+		_, _ = fmt.Fprintf(w, "  %s:0x%x restored after %d hits\n", site.Module, site.Addr, h.restored[site])
+	}
+}
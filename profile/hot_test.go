@@ -0,0 +1,57 @@
+package profile
+
+import "testing"
+
+func TestHotDecide(t *testing.T) {
+	site := func(addr uint64) Site { return Site{Module: "binary", Addr: addr} }
+	h := NewHot(Policy{Threshold: 10, Budget: 2, Allow: []Range{{Module: "binary", Start: 0x1000, End: 0x2000}}})
+
+	tests := []struct {
+		name      string
+		site      Site
+		hits      uint64
+		restore   bool
+		obfuscate *Site
+	}{
+		{"below threshold", site(0x1000), 9, false, nil},
+		{"threshold", site(0x1000), 10, true, nil},
+		{"already restored", site(0x1000), 100, false, nil},
+		{"not allowed", site(0x2000), 100, false, nil},
+		{"other module", Site{Module: "libfoo.so.1", Addr: 0x1000}, 100, false, nil},
+		{"budget", site(0x1010), 20, true, nil},
+		{"not twice as hot", site(0x1020), 19, false, nil},
+		{"evicts coldest", site(0x1020), 30, true, &[]Site{site(0x1000)}[0]},
+		{"evicted again", site(0x1000), 39, false, nil},
+		{"evicts next coldest", site(0x1000), 40, true, &[]Site{site(0x1010)}[0]},
+	}
+	for _, test := range tests {
+		restore, obfuscate := h.Decide(test.site, test.hits)
+		if restore != test.restore || (obfuscate == nil) != (test.obfuscate == nil) ||
+			obfuscate != nil && *obfuscate != *test.obfuscate {
+			t.Errorf("%s: decided %v, %v, want %v, %v", test.name, restore, obfuscate, test.restore, test.obfuscate)
+		}
+	}
+
+	for _, restored := range []uint64{0x1000, 0x1020} {
+		if !h.Restored(site(restored)) {
+			t.Errorf("%#x isn't restored", restored)
+		}
+	}
+	if h.Restored(site(0x1010)) || h.evictions != 2 {
+		t.Errorf("%#x restored, %d evictions", 0x1010, h.evictions)
+	}
+}
+
+func TestHotDecideDisabled(t *testing.T) {
+	h := NewHot(Policy{})
+	if restore, _ := h.Decide(Site{Module: "binary", Addr: 0x1000}, 1<<40); restore {
+		t.Error("restored without threshold")
+	}
+
+	h = NewHot(Policy{Threshold: 1})
+	for addr := uint64(0); addr < 100; addr++ {
+		if restore, obfuscate := h.Decide(Site{Module: "binary", Addr: addr}, 1); !restore || obfuscate != nil {
+			t.Errorf("%#x: decided %v, %v without budget", addr, restore, obfuscate)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package profile
+
+import (
+	"encoding/json"
+	"io/ioutil"
+)
+
+// Site identifies an obfuscated instruction by the name of its module and its address in the ELF
+type Site struct {
+	Module string
+	Addr   uint64
+}
+
+// Profile counts how often the obfuscated instructions were hit
+// It is written by the runtime in profiling mode and can be used by the packer to select the
+// instructions to obfuscate. The JSON representation maps the module names to the hits per address:
+//
+//	{"modules": {"du": {"4112": 3, "4160": 1024}}}
+type Profile struct {
+	Modules map[string]map[uint64]uint64 `json:"modules"`
+}
+
+// New creates an empty profile
+func New() *Profile {
+	return &Profile{Modules: make(map[string]map[uint64]uint64)}
+}
+
+// Hit counts a hit of a site and returns the number of hits so far
+func (p *Profile) Hit(site Site) uint64 {
+	hits, exists := p.Modules[site.Module]
+	if !exists {
+		hits = make(map[uint64]uint64)
+		p.Modules[site.Module] = hits
+	}
+	hits[site.Addr]++
+	return hits[site.Addr]
+}
+
+// Hits returns the number of hits of a site
+func (p *Profile) Hits(site Site) uint64 {
+	return p.Modules[site.Module][site.Addr]
+}
+
+// Total returns the number of hits of all sites of a module
+func (p *Profile) Total(module string) uint64 {
+	total := uint64(0)
+	for _, hits := range p.Modules[module] {
+		total += hits
+	}
+	return total
+}
+
+// Read a profile from a JSON file
+func Read(file string) (*Profile, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	p := New()
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, err
+	}
+	if p.Modules == nil {
+		p.Modules = make(map[string]map[uint64]uint64)
+	}
+	return p, nil
+}
+
+// Write the profile into a JSON file
+func (p *Profile) Write(file string) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, data, 0644)
+}
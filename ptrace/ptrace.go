@@ -3,6 +3,7 @@
 package ptrace
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -11,8 +12,25 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"unsafe"
 )
 
+// FollowOptions are the ptrace options making the tracer follow all threads
+// and child processes of a tracee as well as exec's.
+// All tracees are killed, if the tracer exits. Syscall-stops are reported as SyscallTrap.
+const FollowOptions = syscall.PTRACE_O_TRACECLONE |
+	syscall.PTRACE_O_TRACEFORK |
+	syscall.PTRACE_O_TRACEVFORK |
+	syscall.PTRACE_O_TRACEEXEC |
+	syscall.PTRACE_O_TRACESYSGOOD |
+	ptraceOExitKill
+
+// SyscallTrap is the stop signal of syscall-stops with PTRACE_O_TRACESYSGOOD
+const SyscallTrap = syscall.SIGTRAP | 0x80
+
+// PTRACE_O_EXITKILL isn't defined by the syscall package
+const ptraceOExitKill = 0x100000
+
 var (
 	// ErrExited is returned when a command is executed on a tracee
 	// that has already exited.
@@ -22,6 +40,13 @@ var (
 // An Event is sent on a Tracee's event channel whenever it changes state.
 type Event interface{}
 
+// A Status is sent as Event whenever one of the traced threads changes state.
+// Tid identifies the thread, the embedded wait status describes the change.
+type Status struct {
+	Tid int
+	syscall.WaitStatus
+}
+
 // A Tracee is a process that is being traced.
 type Tracee struct {
 	proc   *os.Process
@@ -41,6 +66,22 @@ type SectionInfo struct {
 	Name string
 }
 
+// Pid returns the process id of the initially executed process.
+// This is also the thread id of its main thread.
+func (t *Tracee) Pid() int {
+	return t.proc.Pid
+}
+
+// Siginfo contains the leading fields of the kernel's siginfo_t
+type Siginfo struct {
+	Signo int32
+	Errno int32
+	Code  int32
+	_     int32
+	Addr  uint64 // Faulting address for SIGILL, SIGFPE, SIGSEGV, SIGBUS and SIGTRAP
+	_     [104]byte
+}
+
 // Events returns the events channel for the tracee.
 func (t *Tracee) Events() <-chan Event {
 	return t.events
@@ -48,6 +89,8 @@ func (t *Tracee) Events() <-chan Event {
 
 // Exec executes a process with tracing enabled, returning the Tracee
 // or an error if an error occurs while executing the process.
+// The process is placed into its own process group. If the tracer is in the foreground of its terminal,
+// the tracee takes its place, so signals generated by the terminal only reach the tracee.
 func Exec(name string, argv []string) (*Tracee, error) {
 	t := &Tracee{
 		events: make(chan Event, 1),
@@ -62,8 +105,11 @@ func Exec(name string, argv []string) (*Tracee, error) {
 		p, e := os.StartProcess(name, argv, &os.ProcAttr{
 			Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
 			Sys: &syscall.SysProcAttr{
-				Ptrace:    true,
-				Pdeathsig: syscall.SIGCHLD,
+				Ptrace:     true,
+				Pdeathsig:  syscall.SIGCHLD,
+				Setpgid:    true,
+				Foreground: foregroundGroup() == syscall.Getpgrp(),
+				Ctty:       0, // Stdin
 			},
 			Env: os.Environ(),
 		})
@@ -79,38 +125,119 @@ func Exec(name string, argv []string) (*Tracee, error) {
 	return t, <-err
 }
 
-// Detach detaches the tracee, allowing it to continue its execution normally.
+// Foreground places the process group of the tracee into the foreground of the terminal,
+// if the tracer is in the foreground, e.g. after the shell put it there. Returns whether it did so.
+func (t *Tracee) Foreground() bool {
+	return foregroundGroup() == syscall.Getpgrp() && setForegroundGroup(t.proc.Pid) == nil
+}
+
+// Background gives the terminal back to the tracer, if the tracee is in the foreground
+func (t *Tracee) Background() error {
+	if foregroundGroup() != t.proc.Pid {
+		return nil
+	}
+	// The tracer is in the background, so it would be stopped by SIGTTOU, unless the signal is blocked
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	var mask, old uint64 = 1 << (syscall.SIGTTOU - 1), 0
+	const sigBlock, sigSetmask = 0, 2
+	_, _, _ = syscall.RawSyscall6(syscall.SYS_RT_SIGPROCMASK, sigBlock, uintptr(unsafe.Pointer(&mask)), uintptr(unsafe.Pointer(&old)), 8, 0, 0)
+	defer syscall.RawSyscall6(syscall.SYS_RT_SIGPROCMASK, sigSetmask, uintptr(unsafe.Pointer(&old)), 0, 8, 0, 0)
+	return setForegroundGroup(syscall.Getpgrp())
+}
+
+// Get the foreground process group of the terminal of stdin, -1 if there is no terminal
+func foregroundGroup() int {
+	var pgrp int32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, 0, syscall.TIOCGPGRP, uintptr(unsafe.Pointer(&pgrp))); errno != 0 {
+		return -1
+	}
+	return int(pgrp)
+}
+
+// Set the foreground process group of the terminal of stdin
+func setForegroundGroup(pgrp int) error {
+	p := int32(pgrp)
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, 0, syscall.TIOCSPGRP, uintptr(unsafe.Pointer(&p))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Detach detaches the thread tid, allowing it to continue its execution normally.
 // No more tracing is performed, and no events are sent on the event channel
-// until the tracee exits.
-func (t *Tracee) Detach() error {
+// for this thread.
+func (t *Tracee) Detach(tid int) error {
 	err := make(chan error, 1)
-	if t.do(func() { err <- syscall.PtraceDetach(t.proc.Pid) }) {
+	if t.do(func() { err <- syscall.PtraceDetach(tid) }) {
 		return <-err
 	}
 	return ErrExited
 }
 
-// SingleStep continues the tracee for one instruction.
-func (t *Tracee) SingleStep() error {
+// SingleStep continues the thread tid for one instruction.
+func (t *Tracee) SingleStep(tid int) error {
 	err := make(chan error, 1)
-	if t.do(func() { err <- syscall.PtraceSingleStep(t.proc.Pid) }) {
+	if t.do(func() { err <- syscall.PtraceSingleStep(tid) }) {
 		return <-err
 	}
 	return ErrExited
 }
 
-// Continue makes the tracee execute unmanaged by the tracer.  Most
+// Continue makes the thread tid execute unmanaged by the tracer.  Most
 // commands are not possible in this state, with the notable exception
 // of sending a syscall.SIGSTOP signal.
-func (t *Tracee) Continue() error {
+// If signum is not 0, the signal is delivered to the thread.
+func (t *Tracee) Continue(tid int, signum syscall.Signal) error {
+	err := make(chan error, 1)
+	if t.do(func() { err <- syscall.PtraceCont(tid, int(signum)) }) {
+		return <-err
+	}
+	return ErrExited
+}
+
+// Syscall continues the thread tid like Continue, but stops it again
+// at the next entry to or exit from a system call.
+func (t *Tracee) Syscall(tid int, signum syscall.Signal) error {
+	err := make(chan error, 1)
+	if t.do(func() { err <- syscall.PtraceSyscall(tid, int(signum)) }) {
+		return <-err
+	}
+	return ErrExited
+}
+
+// GetSiginfo fetches information about the signal that caused the stop of thread tid.
+// It fails with syscall.EINVAL, if the thread is in a group-stop.
+func (t *Tracee) GetSiginfo(tid int) (*Siginfo, error) {
+	err := make(chan error, 1)
+	info := new(Siginfo)
+	if t.do(func() { err <- ptraceGetSiginfo(tid, info) }) {
+		return info, <-err
+	}
+	return nil, ErrExited
+}
+
+// SetOptions sets the ptrace options (syscall.PTRACE_O_*) of the stopped thread tid.
+// Threads created by a traced thread inherit its options.
+func (t *Tracee) SetOptions(tid int, options int) error {
 	err := make(chan error, 1)
-	const signum = 0
-	if t.do(func() { err <- syscall.PtraceCont(t.proc.Pid, signum) }) {
+	if t.do(func() { err <- syscall.PtraceSetOptions(tid, options) }) {
 		return <-err
 	}
 	return ErrExited
 }
 
+// GetEventMsg fetches the message of the last ptrace event of the stopped thread tid,
+// e.g. the thread id of a new thread for syscall.PTRACE_EVENT_CLONE.
+func (t *Tracee) GetEventMsg(tid int) (uint, error) {
+	err := make(chan error, 1)
+	msg := make(chan uint, 1)
+	if t.do(func() { m, e := syscall.PtraceGetEventMsg(tid); msg <- m; err <- e }) {
+		return <-msg, <-err
+	}
+	return 0, ErrExited
+}
+
 // Kill sends the given signal to the tracee.
 func (t *Tracee) Kill(sig syscall.Signal) error {
 	err := make(chan error, 1)
@@ -145,19 +272,24 @@ func (t *Tracee) Close() error {
 	return err
 }
 
+// Wait for all traced threads. The channel is closed as soon as there
+// are no traced threads left.
 func (t *Tracee) wait() {
 	defer close(t.events)
 	for {
-		state, err := t.proc.Wait()
-		if err != nil {
-			t.err <- err
+		var status syscall.WaitStatus
+		tid, err := syscall.Wait4(-1, &status, syscall.WALL, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err == syscall.ECHILD {
 			return
 		}
-		if state.Exited() {
-			t.events <- Event(state.Sys().(syscall.WaitStatus))
+		if err != nil {
+			t.err <- err
 			return
 		}
-		t.events <- Event(state.Sys().(syscall.WaitStatus))
+		t.events <- Event(Status{Tid: tid, WaitStatus: status})
 	}
 }
 
@@ -167,67 +299,122 @@ func (t *Tracee) trace() {
 	}
 }
 
-// Read registers of Tracee
-func (t *Tracee) GetRegs(regs *syscall.PtraceRegs) error {
+// Read registers of thread tid
+func (t *Tracee) GetRegs(tid int, regs *syscall.PtraceRegs) error {
 	err := make(chan error, 1)
-	if t.do(func() { err <- syscall.PtraceGetRegs(t.proc.Pid, regs) }) {
+	if t.do(func() { err <- syscall.PtraceGetRegs(tid, regs) }) {
 		return <-err
 	}
 	return ErrExited
 }
 
-// Write registers of Tracee
-func (t *Tracee) SetRegs(regs *syscall.PtraceRegs) error {
+// Write registers of thread tid
+func (t *Tracee) SetRegs(tid int, regs *syscall.PtraceRegs) error {
 	err := make(chan error, 1)
-	if t.do(func() { err <- syscall.PtraceSetRegs(t.proc.Pid, regs) }) {
+	if t.do(func() { err <- syscall.PtraceSetRegs(tid, regs) }) {
 		return <-err
 	}
 	return ErrExited
 }
 
-// Read memory of Tracee
-func (t *Tracee) Peek(addr uintptr, data []byte) (int, error) {
+// Read memory of the process containing thread tid
+func (t *Tracee) Peek(tid int, addr uintptr, data []byte) (int, error) {
 	err := make(chan error, 1)
 	count := make(chan int, 1)
-	if t.do(func() { c, e := syscall.PtracePeekText(t.proc.Pid, addr, data); count <- c; err <- e }) {
+	if t.do(func() { c, e := syscall.PtracePeekText(tid, addr, data); count <- c; err <- e }) {
 		return <-count, <-err
 	}
 	return 0, ErrExited
 }
 
-// Write memory of Tracee
-func (t *Tracee) Poke(addr uintptr, data []byte) (int, error) {
+// Write memory of the process containing thread tid
+func (t *Tracee) Poke(tid int, addr uintptr, data []byte) (int, error) {
 	err := make(chan error, 1)
 	count := make(chan int, 1)
-	if t.do(func() { c, e := syscall.PtracePokeText(t.proc.Pid, addr, data); count <- c; err <- e }) {
+	if t.do(func() { c, e := syscall.PtracePokeText(tid, addr, data); count <- c; err <- e }) {
 		return <-count, <-err
 	}
 	return 0, ErrExited
 }
 
-// Fetch virtual memory layout
+// Write exactly the given bytes into memory of the process containing thread tid
+// Unlike Poke, which reads and writes whole words, it doesn't lose concurrent stores of other threads
+// to the surrounding bytes, as it writes through /proc/tid/mem.
+func (t *Tracee) Write(tid int, addr uintptr, data []byte) (int, error) {
+	mem, err := os.OpenFile(fmt.Sprintf("/proc/%v/mem", tid), os.O_WRONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer mem.Close()
+	return mem.WriteAt(data, int64(addr))
+}
+
+// Fetch virtual memory layout of process pid
 // This can't be done via ptrace, but via the /proc filesystem
-func (t *Tracee) Memmap() ([]byte, error) {
-	return ioutil.ReadFile(fmt.Sprintf("/proc/%v/maps", t.proc.Pid))
+func (t *Tracee) Memmap(pid int) ([]byte, error) {
+	return ioutil.ReadFile(fmt.Sprintf("/proc/%v/maps", pid))
 }
 
-// Iterate through the memory mapped sections to find the first executable segment
-// (which usually contains the mapped .text section)
-func (t *Tracee) FirstExecSection() (*SectionInfo, error) {
-	memmap, err := t.Memmap()
+// Parse all memory mapped sections of process pid
+func (t *Tracee) Sections(pid int) ([]*SectionInfo, error) {
+	memmap, err := t.Memmap(pid)
 	if err != nil {
 		return nil, err
 	}
-	lines := strings.Split(string(memmap), "\n")
-	for _, line := range lines {
-		if strings.Contains(line, "x") {
-			parts := strings.Split(line, " ")
-			if len(parts) >= 2 && parts[1][2] == 'x' {
-				return parseSectionInfo(parts), nil
-			}
+	sections := make([]*SectionInfo, 0)
+	for _, line := range strings.Split(string(memmap), "\n") {
+		parts := strings.Split(line, " ")
+		if len(parts) >= 2 {
+			sections = append(sections, parseSectionInfo(parts))
 		}
 	}
-	return nil, fmt.Errorf("no executable section found")
+	return sections, nil
+}
+
+// Read the auxiliary vector of process pid, which the kernel passed to the program on exec
+// The keys are the AT_* constants, e.g. 9 for AT_ENTRY.
+func (t *Tracee) Auxv(pid int) (map[uint64]uint64, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%v/auxv", pid))
+	if err != nil {
+		return nil, err
+	}
+	auxv := make(map[uint64]uint64)
+	for i := 0; i+16 <= len(data); i += 16 {
+		key := binary.LittleEndian.Uint64(data[i:])
+		if key == 0 { // AT_NULL
+			break
+		}
+		auxv[key] = binary.LittleEndian.Uint64(data[i+8:])
+	}
+	return auxv, nil
+}
+
+// Determine the process id (thread group id) a thread belongs to
+func (t *Tracee) Tgid(tid int) (int, error) {
+	status, err := ioutil.ReadFile(fmt.Sprintf("/proc/%v/status", tid))
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		if strings.HasPrefix(line, "Tgid:") {
+			return strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "Tgid:")))
+		}
+	}
+	return 0, fmt.Errorf("no tgid found for thread %v", tid)
+}
+
+// Describe the executable file currently run by process pid
+func (t *Tracee) Executable(pid int) (os.FileInfo, error) {
+	return os.Stat(fmt.Sprintf("/proc/%v/exe", pid))
+}
+
+// PTRACE_GETSIGINFO isn't wrapped by the syscall package
+func ptraceGetSiginfo(tid int, info *Siginfo) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_PTRACE, syscall.PTRACE_GETSIGINFO, uintptr(tid), 0, uintptr(unsafe.Pointer(info)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
 }
 
 // Helper function for parsing the textual representation from /proc/<PID>/maps
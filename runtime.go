@@ -1,16 +1,26 @@
 package main
 
 import (
+	"bytes"
 	"debug/elf"
 	"encoding/binary"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/BlobbyBob/PtraceObfuscator/bin"
 	"github.com/BlobbyBob/PtraceObfuscator/common"
+	"github.com/BlobbyBob/PtraceObfuscator/crash"
+	"github.com/BlobbyBob/PtraceObfuscator/payload"
+	"github.com/BlobbyBob/PtraceObfuscator/profile"
 	"github.com/BlobbyBob/PtraceObfuscator/ptrace"
-	"golang.org/x/arch/x86/x86asm"
+	"github.com/BlobbyBob/PtraceObfuscator/trace"
+	"io/ioutil"
 	"log"
+	"math/rand"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"syscall"
 	"unsafe"
 )
@@ -26,110 +36,1324 @@ func main() {
 
 	// BEGIN startup phase
 
+	// Read the payload appended to the runtime
+	self, err := os.Executable()
+	if err != nil {
+		log.Fatalln("can't locate runtime:", err)
+	}
+	p, err := payload.Read(self)
+	if err != nil {
+		log.Fatalln("can't read payload:", err)
+	}
+
 	// Deserialize metadata
-	metadata, err := readMetadata()
+	metadata, err := readMetadata(p)
 	if err != nil {
 		log.Fatalln("can't read metadata:", err)
 	}
 
-	// Create in-memory file for obfuscated binary
-	obfName := "obf"
-	obfFd, _, _ := syscall.Syscall(319, uintptr(unsafe.Pointer(&obfName)), 0, 0) // 319 = memfd_create
-	_, _ = syscall.Write(int(obfFd), bin.Obf)
-	obfFdPath := fmt.Sprintf("/proc/self/fd/%d", obfFd)
+	// Create in-memory files for the obfuscated binary and libraries
+	binary, obfFdPath, err := createModule(p.Binary, metadata[0])
+	if err != nil {
+		log.Fatalln("can't create binary:", err)
+	}
+	modules := []*module{binary}
+
+	// The dynamic loader searches the libraries by their soname
+	libDir := ""
+	if len(p.Libraries) > 0 {
+		if libDir, err = ioutil.TempDir("", "ptobf"); err != nil {
+			log.Fatalln("can't create library directory:", err)
+		}
+		for i, lib := range p.Libraries {
+			m, path, err := createModule(lib, metadata[i+1])
+			if err != nil {
+				log.Fatalln("can't create library:", err)
+			}
+			if err := os.Symlink(path, filepath.Join(libDir, m.name)); err != nil {
+				log.Fatalln("can't create library:", err)
+			}
+			modules = append(modules, m)
+		}
+		_ = os.Setenv("LD_LIBRARY_PATH", strings.TrimSuffix(libDir+":"+os.Getenv("LD_LIBRARY_PATH"), ":"))
+	}
+
+	hot, err := hotPolicy()
+	if err != nil {
+		log.Fatalln("invalid hot-branch policy:", err)
+	}
+	onError, err := parseFailurePolicy(os.Getenv("PTOBF_ON_ERROR"))
+	if err != nil {
+		log.Fatalln("invalid failure policy:", err)
+	}
+
+	d := &dispatcher{
+		modules:   modules,
+		processes: make(map[int]*process),
+		threads:   make(map[int]*thread),
+		hot:       hot,
+		onError:   onError,
+		history:   crash.NewHistory(historySize),
+		libDir:    libDir,
+	}
+	if profileFile != "" || hot != nil {
+		d.profile = profile.New()
+	}
+	if traceFile != "" {
+		names := make([]string, len(modules))
+		for i, m := range modules {
+			names[i] = m.name
+		}
+		if d.trace, err = trace.Create(traceFile, names); err != nil {
+			log.Fatalln("can't create trace:", err)
+		}
+	}
+
+	// The tracee gets its own process group, which takes the place of ours in the foreground of the terminal.
+	// Thus, signals generated by the terminal reach the tracee directly, while the runtime only receives
+	// signals sent explicitly. These are forwarded to the traced processes.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGUSR2,
+		syscall.SIGCONT)
+
+	// Start execution with PTRACE_TRACEME
+	// Everything that may fail is set up before, so a failure doesn't leave the tracee behind untraced.
+	tracee, err := ptrace.Exec(obfFdPath, os.Args)
+	if err != nil {
+		log.Fatalln("can't exec binary:", err)
+	}
+	d.tracee = tracee
+	ev := tracee.Events()
+
+	// END of startup phase
+
+	// BEGIN operation phase
+
+	// The channel is closed as soon as neither the tracee nor any of its traced children are alive
+loop:
+	for {
+		select {
+		case e, ok := <-ev:
+			if !ok {
+				break loop
+			}
+			// Wait for a thread of the tracee to pause
+			if err := d.handle(e.(ptrace.Status)); err != nil {
+				d.fail(err)
+			}
+		case sig := <-sigs:
+			d.forward(sig.(syscall.Signal))
+		}
+	}
+
+	signal.Stop(sigs)
+	_ = tracee.Background()
+	if err := tracee.Close(); err != nil {
+		log.Fatalln("can't close tracee:", err)
+	}
+	if libDir != "" {
+		_ = os.RemoveAll(libDir)
+	}
+	d.writeProfile()
+	if d.trace != nil {
+		if err := d.trace.Close(); err != nil {
+			log.Println("can't write trace:", err)
+		}
+	}
+	if d.failed {
+		os.Exit(1)
+	}
+
+	// Terminate the same way the tracee did
+	if d.exitStatus.Signaled() {
+		raise(d.exitStatus.Signal(), d.exitStatus.CoreDump())
+	}
+	os.Exit(d.exitStatus.ExitStatus())
+}
+
+// Kill the runtime with the signal that killed the tracee
+// A core is only dumped if the tracee dumped one, too. As the runtime dumps its own core,
+// a core dump of the tracee might be overwritten depending on /proc/sys/kernel/core_pattern.
+func raise(sig syscall.Signal, coreDump bool) {
+	runtime.LockOSThread()
+	if !coreDump {
+		_ = syscall.Setrlimit(syscall.RLIMIT_CORE, &syscall.Rlimit{})
+	}
+
+	// The Go runtime installs handlers for most signals, so we restore the default action
+	// and unblock the signal for this thread
+	signal.Reset(sig)
+	var action [4]uint64 // struct sigaction: handler (SIG_DFL), flags, restorer, mask
+	_, _, _ = syscall.RawSyscall6(syscall.SYS_RT_SIGACTION, uintptr(sig), uintptr(unsafe.Pointer(&action)), 0, 8, 0, 0)
+	mask := uint64(1) << (uint(sig) - 1)
+	_, _, _ = syscall.RawSyscall6(syscall.SYS_RT_SIGPROCMASK, 1, uintptr(unsafe.Pointer(&mask)), 0, 8, 0, 0) // 1 = SIG_UNBLOCK
+
+	_ = syscall.Tgkill(syscall.Getpid(), syscall.Gettid(), sig)
+
+	// The signal doesn't terminate the process (e.g. SIGCHLD), so we use the shell's convention
+	os.Exit(128 + int(sig))
+}
+
+// Runtime options, which are read from the environment
+var (
+	// Verify the return addresses of obfuscated returns against the ones pushed by obfuscated calls
+	shadowStack = os.Getenv("PTOBF_SHADOW_STACK") != ""
+
+	// Write the number of hits per obfuscated instruction into this file
+	profileFile = os.Getenv("PTOBF_PROFILE")
+
+	// Write the report of the hot-branch restoration into this file, - is stderr
+	hotReport = os.Getenv("PTOBF_HOT_REPORT")
+
+	// Write crash reports into this file instead of ptobf-crash-<pid>.json
+	crashReport = os.Getenv("PTOBF_CRASH_REPORT")
+
+	// Record every handled breakpoint into this trace file
+	traceFile = os.Getenv("PTOBF_TRACE")
+)
+
+// What happens to the tracee, if the runtime fails to handle a stop of one of its threads
+type failurePolicy int
+
+const (
+	failKill   failurePolicy = iota // Kill all traced processes
+	failCore                        // Abort the failing process with SIGABRT, which dumps a core
+	failReport                      // Write a crash report and kill all traced processes
+	failDetach                      // Detach the failing thread and let it run on its own
+)
+
+// Parse the failure policy given by PTOBF_ON_ERROR, kill by default
+func parseFailurePolicy(policy string) (failurePolicy, error) {
+	switch policy {
+	case "", "kill":
+		return failKill, nil
+	case "core":
+		return failCore, nil
+	case "report":
+		return failReport, nil
+	case "detach":
+		return failDetach, nil
+	}
+	return failKill, fmt.Errorf("PTOBF_ON_ERROR: unknown policy %q", policy)
+}
+
+// Read the policy for restoring hot obfuscated instructions from the environment
+//   PTOBF_HOT_THRESHOLD - number of hits after which an instruction is restored
+//   PTOBF_HOT_BUDGET    - maximum number of restored instructions
+//   PTOBF_HOT_ALLOW     - address ranges of instructions, that may be restored (see profile.ParseAllowList)
+// Returns nil, if restoring is disabled.
+func hotPolicy() (*profile.Hot, error) {
+	var policy profile.Policy
+	var err error
+	if threshold := os.Getenv("PTOBF_HOT_THRESHOLD"); threshold != "" {
+		if policy.Threshold, err = strconv.ParseUint(threshold, 10, 64); err != nil {
+			return nil, fmt.Errorf("PTOBF_HOT_THRESHOLD: %v", err)
+		}
+	}
+	if policy.Threshold == 0 {
+		return nil, nil
+	}
+	if budget := os.Getenv("PTOBF_HOT_BUDGET"); budget != "" {
+		if policy.Budget, err = strconv.Atoi(budget); err != nil {
+			return nil, fmt.Errorf("PTOBF_HOT_BUDGET: %v", err)
+		}
+	}
+	if policy.Allow, err = profile.ParseAllowList(os.Getenv("PTOBF_HOT_ALLOW")); err != nil {
+		return nil, fmt.Errorf("PTOBF_HOT_ALLOW: %v", err)
+	}
+	return profile.NewHot(policy), nil
+}
+
+// Returned by performOriginalInstruction, if a thread stopped at an unknown offset
+var errNoMatchingOffset = errors.New("No matching offset found")
+
+// Returned by performOriginalInstruction, if the metadata contains an instruction the runtime can't perform
+var errUnknownInstruction = errors.New("unknown instruction")
+
+// Returned by performOriginalInstruction, if an obfuscated return doesn't match the shadow stack
+var errShadowStack = errors.New("return address doesn't match shadow stack")
+
+// A failure while handling a stop of a thread of the tracee
+// The thread is still stopped, the failure policy decides what happens to it.
+type traceError struct {
+	tid    int
+	sig    syscall.Signal // Signal the thread stopped with
+	action string
+	err    error
+}
+
+func (e *traceError) Error() string {
+	return fmt.Sprintf("thread %d: %s: %v", e.tid, e.action, e.err)
+}
+
+func (e *traceError) Unwrap() error {
+	return e.err
+}
+
+// Forward a signal received by the runtime to all traced processes
+// The initial process might have exited already, while its children are still running.
+func (d *dispatcher) forward(sig syscall.Signal) {
+	if sig == syscall.SIGCONT {
+		// The shell continues a stopped runtime after putting it in the foreground (fg)
+		d.tracee.Foreground()
+	}
+	if len(d.processes) == 0 {
+		// The initial process didn't stop yet
+		_ = syscall.Kill(d.tracee.Pid(), sig)
+	}
+	for pid := range d.processes {
+		_ = syscall.Kill(pid, sig)
+	}
+}
+
+// An obfuscated ELF file, i.e. the binary or one of the shared libraries, together with its metadata
+type module struct {
+	name       string      // For shared libraries the soname
+	file       os.FileInfo // The in-memory file
+	entry      uint64      // Entry point given by the ELF header
+	firstVaddr uint64      // Virtual address of the first page
+	dynamic    uint64      // Virtual address of the dynamic section, 0 if there is none
+	regions    []common.Region
+	metadata   *common.InstructionStore
+}
+
+// State of a single traced process
+type process struct {
+	pid       int
+	modules   []*mappedModule // Indexed like the modules of the dispatcher, nil if a library isn't loaded (yet)
+	ready     bool            // Whether the breakpoints are set in the current image of the process
+	debugHook uint64          // Address of the breakpoint in the debug hook of the dynamic loader, 0 if not set
+}
+
+// A module mapped into a process
+type mappedModule struct {
+	*module
+	base    uint64 // Load base
+	regions []mappedRegion
+}
+
+// A code region of a module mapped into a process
+type mappedRegion struct {
+	common.Region
+	start uint64 // Runtime address of the region
+}
+
+// Translate the address of an obfuscated instruction in the ELF into its runtime address
+func (m *mappedModule) runtimeAddr(addr uint64, region uint16) uint64 {
+	r := m.regions[region]
+	return r.start + addr - r.Addr
+}
+
+// Translate a runtime address into the address in the ELF of the module containing it
+// Returns false, if the address isn't located in any code region.
+func (p *process) elfAddr(addr uint64) (*mappedModule, uint64, bool) {
+	for _, m := range p.modules {
+		if m == nil {
+			continue
+		}
+		for _, region := range m.regions {
+			if addr >= region.start && addr < region.start+region.Size {
+				return m, region.Addr + addr - region.start, true
+			}
+		}
+	}
+	return nil, 0, false
+}
+
+// Check whether there are libraries, that aren't loaded yet
+func (p *process) pending() bool {
+	for _, m := range p.modules {
+		if m == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// State of a single thread of a traced process
+type thread struct {
+	tid    int
+	proc   *process
+	regs   syscall.PtraceRegs // Registers at the last breakpoint
+	new    bool               // Whether we still expect the initial SIGSTOP of the thread
+	shadow shadowStackFrames  // Return addresses pushed by emulated calls
+}
+
+// A return address pushed by an emulated call together with its location on the stack
+type shadowStackFrame struct {
+	rsp  uint64
+	addr uint64
+}
+
+// The shadow stack of a thread, the most recent frame is last
+// Only calls and returns that are obfuscated are tracked. Returns to frames we don't know about,
+// e.g. set up by calls in shared libraries, are accepted.
+type shadowStackFrames []shadowStackFrame
+
+// Record a return address pushed onto the stack at rsp
+func (s *shadowStackFrames) push(rsp uint64, addr uint64) {
+	// Frames at or below the new one are stale, since the stack grows down
+	s.discard(rsp + 1)
+	*s = append(*s, shadowStackFrame{rsp: rsp, addr: addr})
+}
+
+// Check the return address popped from the stack at rsp
+// Returns false, if the return address was tampered with.
+func (s *shadowStackFrames) pop(rsp uint64, addr uint64) bool {
+	// Frames below the current stack pointer are stale, e.g. due to longjmp or exceptions
+	s.discard(rsp)
+	frames := *s
+	if len(frames) == 0 || frames[len(frames)-1].rsp != rsp {
+		return true
+	}
+	*s = frames[:len(frames)-1]
+	return frames[len(frames)-1].addr == addr
+}
+
+// Drop all frames located below rsp
+func (s *shadowStackFrames) discard(rsp uint64) {
+	frames := *s
+	for len(frames) > 0 && frames[len(frames)-1].rsp < rsp {
+		frames = frames[:len(frames)-1]
+	}
+	*s = frames
+}
+
+// The dispatcher keeps track of all traced processes and threads and handles their stops
+type dispatcher struct {
+	tracee     *ptrace.Tracee
+	modules    []*module // The binary, followed by the libraries
+	processes  map[int]*process
+	threads    map[int]*thread
+	exitStatus syscall.WaitStatus // Final status of the initial process
+	profile    *profile.Profile   // Hits per obfuscated instruction, nil if not counting
+	hot        *profile.Hot       // Restored hot instructions, nil if disabled
+	onError    failurePolicy
+	failed     bool           // Whether the tracee was killed due to a failure
+	history    *crash.History // Recently handled breakpoints for crash reports
+	trace      *trace.Writer  // Records the handled breakpoints, nil if disabled
+	libDir     string         // Directory of the obfuscated libraries in LD_LIBRARY_PATH, empty without libraries
+}
+
+// Number of handled breakpoints and obfuscated instructions next to the failing one in crash reports
+const (
+	historySize = 32
+	nearbySites = 8
+)
+
+// Handle a state change of a single thread
+// Failures are returned as *traceError, the thread stays stopped in this case.
+func (d *dispatcher) handle(status ptrace.Status) error {
+	if status.Exited() || status.Signaled() {
+		if status.Tid == d.tracee.Pid() {
+			d.exitStatus = status.WaitStatus
+		}
+		d.remove(status.Tid)
+		return nil
+	}
+
+	th, err := d.thread(status.Tid)
+	if errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ESRCH) {
+		// The thread is already gone again
+		return nil
+	} else if err != nil {
+		return &traceError{tid: status.Tid, sig: status.StopSignal(), action: "can't prepare thread", err: err}
+	}
+	fail := func(action string, err error) error {
+		return &traceError{tid: th.tid, sig: status.StopSignal(), action: action, err: err}
+	}
+
+	var sig syscall.Signal
+	switch {
+	case th.new && status.StopSignal() == syscall.SIGSTOP:
+		// The first stop of a new thread or process is caused by the SIGSTOP of the auto-attach
+		th.new = false
+	case status.StopSignal() == ptrace.SyscallTrap:
+		// We trace the system calls until all libraries are loaded
+		if err := d.syscall(th); err != nil {
+			return fail("can't set breakpoints", err)
+		}
+	case (status.StopSignal() == syscall.SIGILL || status.StopSignal() == syscall.SIGSEGV) && d.faultingTrap(th, status.StopSignal()):
+		// Traps other than INT3 and INT1 fault, they are reported as SIGILL or SIGSEGV at the trap
+		err := d.performOriginalInstruction(th, status.StopSignal())
+		if err == errNoMatchingOffset {
+			sig = status.StopSignal()
+		} else if err != nil {
+			return fail("can't perform original instruction", err)
+		}
+	case status.StopSignal() != syscall.SIGTRAP:
+		// The tracee received a signal, which we need to pass on, unless it's a group-stop
+		sig = d.pendingSignal(th, status.StopSignal())
+	case status.TrapCause() == syscall.PTRACE_EVENT_CLONE,
+		status.TrapCause() == syscall.PTRACE_EVENT_FORK,
+		status.TrapCause() == syscall.PTRACE_EVENT_VFORK:
+		// A thread created a new thread or process, we register it unless its stop arrived already
+		tid, err := d.tracee.GetEventMsg(th.tid)
+		if err != nil {
+			return fail("can't get new thread id", err)
+		}
+		if _, exists := d.threads[int(tid)]; !exists {
+			if child, err := d.thread(int(tid)); err == nil {
+				child.new = true
+			}
+		}
+	case status.TrapCause() == syscall.PTRACE_EVENT_EXEC:
+		traced, err := d.exec(th)
+		if err != nil {
+			return fail("can't handle exec", err)
+		}
+		if !traced {
+			return nil
+		}
+	case !th.proc.ready:
+		// The first "pause" is not a breakpoint, but cause by PTRACE_TRACEME
+		// It allows us to prepare the binary with breakpoints
+		if err := d.tracee.SetOptions(th.tid, ptrace.FollowOptions); err != nil {
+			return fail("can't set ptrace options", err)
+		}
+		if err := d.prepare(th); err != nil {
+			return fail("can't set breakpoints", err)
+		}
+	default:
+		// The dynamic loader calls its debug hook before and after loading or unloading libraries
+		if hooked, err := d.debugState(th); err != nil {
+			return fail("can't update libraries", err)
+		} else if hooked {
+			break
+		}
+
+		// All further pauses are caused by a breakpoint
+		// Thus, we perform the original instruction as indicated in the metadata
+		err := d.performOriginalInstruction(th, syscall.SIGTRAP)
+		if err == errNoMatchingOffset && d.sentByUser(th) {
+			// Not a breakpoint, but a SIGTRAP sent by kill, tgkill or similar
+			sig = syscall.SIGTRAP
+		} else if err != nil {
+			return fail("can't perform original instruction", err)
+		}
+	}
+	if err := d.resume(th, sig); err != nil {
+		return fail("can't continue tracee", err)
+	}
+	return nil
+}
+
+// Continue a stopped thread and deliver the signal, unless it is 0
+func (d *dispatcher) resume(th *thread, sig syscall.Signal) error {
+	if th.proc.pending() {
+		return d.tracee.Syscall(th.tid, sig)
+	}
+	return d.tracee.Continue(th.tid, sig)
+}
+
+// Deal with a failure according to the failure policy
+func (d *dispatcher) fail(err error) {
+	log.Println(err)
+	var te *traceError
+	if !errors.As(err, &te) {
+		d.killAll()
+		return
+	}
+
+	// Unknown breakpoints indicate a bug in the obfuscator or the runtime, so they are always reported
+	if errors.Is(err, errNoMatchingOffset) && d.onError != failReport {
+		d.report(te)
+	}
+
+	switch d.onError {
+	case failReport:
+		d.report(te)
+		d.killAll(te.tid)
+	case failKill:
+		d.killAll(te.tid)
+	case failCore:
+		// The thread is continued and receives SIGABRT, unless it's gone in the meantime
+		pid, err := d.tracee.Tgid(te.tid)
+		if err == nil {
+			err = syscall.Tgkill(pid, te.tid, syscall.SIGABRT)
+		}
+		if err == nil {
+			err = d.tracee.Continue(te.tid, 0)
+		}
+		if err != nil {
+			log.Println("can't abort tracee:", err)
+			d.killAll(te.tid)
+		}
+	case failDetach:
+		if err := d.tracee.Detach(te.tid); err != nil {
+			log.Println("can't detach tracee:", err)
+			d.killAll(te.tid)
+			return
+		}
+		delete(d.threads, te.tid)
+	}
+}
+
+// Kill all traced processes
+// The processes of the given threads are killed as well, as they might not be known yet.
+func (d *dispatcher) killAll(tids ...int) {
+	d.failed = true
+	for pid := range d.processes {
+		_ = syscall.Kill(pid, syscall.SIGKILL)
+	}
+	for _, tid := range tids {
+		_ = syscall.Kill(tid, syscall.SIGKILL)
+	}
+}
+
+// Write a crash report for the thread that caused a failure
+func (d *dispatcher) report(te *traceError) {
+	var regs syscall.PtraceRegs
+	if err := d.tracee.GetRegs(te.tid, &regs); err != nil {
+		log.Println("can't write crash report:", err)
+		return
+	}
+	pid, _ := d.tracee.Tgid(te.tid)
+	read := func(addr uintptr, data []byte) (int, error) {
+		return d.tracee.Peek(te.tid, addr, data)
+	}
+	r := crash.New(pid, te.tid, te.sig, te, &regs, read)
+
+	// Unless the trap faulted, the thread stopped after it
+	site := regs.Rip
+	if te.sig == syscall.SIGTRAP {
+		site--
+	}
+	if maps, err := d.tracee.Memmap(pid); err == nil {
+		r.AddMaps(maps)
+	}
+	if th, exists := d.threads[te.tid]; exists {
+		if m, addr, inRegion := th.proc.elfAddr(site); inRegion {
+			nearby, err := m.metadata.Nearby(addr, nearbySites)
+			if err != nil {
+				log.Println("can't decode metadata:", err)
+			}
+			for _, inst := range nearby {
+				r.Metadata = append(r.Metadata, crash.Site{
+					Module:    m.name,
+					Addr:      crash.Hex(inst.Addr),
+					Runtime:   crash.Hex(m.runtimeAddr(inst.Addr, inst.Region)),
+					Trap:      inst.Trap.String(),
+					Semantics: inst.Semantics,
+				})
+			}
+		}
+	}
+	r.Disassemble(site, read)
+	r.History = d.history.Entries()
+
+	file := crashReport
+	if file == "" {
+		file = fmt.Sprintf("ptobf-crash-%d.json", pid)
+	}
+	if err := r.Write(file); err != nil {
+		log.Println("can't write crash report:", err)
+		return
+	}
+	log.Println("crash report written to", file)
+}
+
+// Determine the signal to inject when continuing a thread in a signal-delivery-stop
+// Stopping signals also cause a group-stop after their delivery, which is reported
+// as a stop with the same signal. This one must not be injected again.
+// Without PTRACE_SEIZE, the only option is to continue the thread nevertheless.
+func (d *dispatcher) pendingSignal(th *thread, sig syscall.Signal) syscall.Signal {
+	switch sig {
+	case syscall.SIGSTOP, syscall.SIGTSTP, syscall.SIGTTIN, syscall.SIGTTOU:
+		if _, err := d.tracee.GetSiginfo(th.tid); err == syscall.EINVAL {
+			return 0
+		}
+	}
+	switch sig {
+	case syscall.SIGTTIN, syscall.SIGTTOU:
+		// The shell doesn't notify a running job that it was put in the foreground (fg), so the terminal
+		// is handed over to the tracee, once it accesses it. The access is restarted without the signal.
+		if d.tracee.Foreground() {
+			return 0
+		}
+	}
+	return sig
+}
+
+// Check whether the SIGTRAP a thread stopped with was sent by a process
+// instead of being caused by a breakpoint
+func (d *dispatcher) sentByUser(th *thread) bool {
+	info, err := d.tracee.GetSiginfo(th.tid)
+	// si_code is positive, if the signal was generated by the kernel (SI_KERNEL, TRAP_*)
+	return err == nil && info.Code <= 0
+}
+
+// Check whether a SIGILL or SIGSEGV might have been caused by a trap
+// Invalid opcodes are reported with ILL_ILLOPN, general protection faults with SI_KERNEL and page faults
+// with SEGV_MAPERR. Only page faults in the first page and no signals sent by a process can be caused by a trap.
+func (d *dispatcher) faultingTrap(th *thread, sig syscall.Signal) bool {
+	if !th.proc.ready {
+		return false
+	}
+	info, err := d.tracee.GetSiginfo(th.tid)
+	if err != nil {
+		return false
+	}
+	switch sig {
+	case syscall.SIGILL:
+		return info.Code == 2 // ILL_ILLOPN
+	case syscall.SIGSEGV:
+		// Memory traps load from the first page, other accesses to it are regular crashes, which don't match the metadata
+		return info.Code == 0x80 || // SI_KERNEL
+			info.Code == 1 && info.Addr < common.MemoryTrapLimit // SEGV_MAPERR
+	}
+	return false
+}
+
+// Look up a thread or register it, if we don't know it yet.
+// New threads and processes are attached automatically due to ptrace.FollowOptions.
+// Their first stop might be reported before the corresponding event of the parent thread.
+func (d *dispatcher) thread(tid int) (*thread, error) {
+	if th, exists := d.threads[tid]; exists {
+		return th, nil
+	}
+
+	pid, err := d.tracee.Tgid(tid)
+	if err != nil {
+		return nil, err
+	}
+	p, exists := d.processes[pid]
+	if !exists {
+		// Forked processes inherit the breakpoints of their parent,
+		// only the initial process still needs to be prepared
+		p = &process{pid: pid}
+		if pid != d.tracee.Pid() {
+			if err := d.mapModules(p); err != nil {
+				return nil, err
+			}
+			p.ready = true
+		}
+		d.processes[pid] = p
+	}
+
+	th := &thread{tid: tid, proc: p, new: tid != d.tracee.Pid()}
+	d.threads[tid] = th
+	return th, nil
+}
+
+// Forget about an exited thread
+func (d *dispatcher) remove(tid int) {
+	th, exists := d.threads[tid]
+	if !exists {
+		return
+	}
+	delete(d.threads, tid)
+	if tid == th.proc.pid {
+		delete(d.processes, tid)
+	}
+}
+
+// Set the breakpoints in a process that is executing the obfuscated binary
+// The libraries are prepared as soon as the dynamic loader maps them.
+func (d *dispatcher) prepare(th *thread) error {
+	// The calls of the previous image never return after an exec
+	th.shadow = nil
+	th.proc.modules = nil
+	th.proc.debugHook = 0
+	if err := d.mapModules(th.proc); err != nil {
+		return err
+	}
+	for _, m := range th.proc.modules {
+		if m == nil {
+			continue
+		}
+		if err := setBreakpoints(d.tracee, th.tid, m); err != nil {
+			return err
+		}
+	}
+	th.proc.ready = true
+	return nil
+}
+
+// Handle a syscall-stop
+// After the dynamic loader mapped executable code or unmapped one of our libraries, we update the libraries.
+// As soon as the dynamic loader is set up, we also set a breakpoint in its debug hook, which notices libraries
+// being unloaded after all of them are loaded and the system calls aren't traced anymore.
+func (d *dispatcher) syscall(th *thread) error {
+	if err := d.tracee.GetRegs(th.tid, &th.regs); err != nil {
+		return err
+	}
+	// At the entry of a system call, RAX contains -ENOSYS, failed system calls return another error number
+	if errno := -int64(th.regs.Rax); errno > 0 && errno < 4096 {
+		return nil
+	}
+	switch th.regs.Orig_rax {
+	case syscall.SYS_MMAP:
+		if th.regs.Rdx&syscall.PROT_EXEC == 0 {
+			return nil
+		}
+	case syscall.SYS_MUNMAP:
+		if !th.proc.overlapsLibrary(th.regs.Rdi, th.regs.Rsi) {
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	if err := d.updateLibraries(th); err != nil {
+		return err
+	}
+	if th.proc.debugHook == 0 {
+		return d.setDebugHook(th)
+	}
+	return nil
+}
+
+// Check whether a range of memory overlaps the code of a loaded library
+func (p *process) overlapsLibrary(addr, length uint64) bool {
+	for _, m := range p.modules[1:] {
+		if m == nil {
+			continue
+		}
+		for _, region := range m.regions {
+			if addr < region.start+region.Size && region.start < addr+length {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Update the libraries mapped into a process and set the breakpoints in the ones loaded since the last update
+// Libraries unloaded in the meantime are forgotten, so they are prepared again, when they are loaded anew.
+func (d *dispatcher) updateLibraries(th *thread) error {
+	previous := append([]*mappedModule(nil), th.proc.modules...)
+	if err := d.mapModules(th.proc); err != nil {
+		return err
+	}
+	for i, m := range th.proc.modules {
+		if m != nil && (previous[i] == nil || previous[i].base != m.base) {
+			if err := setBreakpoints(d.tracee, th.tid, m); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Set a breakpoint in the debug hook of the dynamic loader, i.e. the function r_debug.r_brk
+// The dynamic loader publishes r_debug in the DT_DEBUG entry of the binary's dynamic section and calls the
+// hook before and after each change of the loaded libraries. As libraries loaded at startup are initialized
+// before the hook is called, it is only used to notice unloaded libraries. The hook is expected to consist
+// of a return, optionally preceded by ENDBR64, so the breakpoint replaces the return. Otherwise, it isn't set.
+func (d *dispatcher) setDebugHook(th *thread) error {
+	exe := th.proc.modules[0]
+	if exe.dynamic == 0 {
+		return nil
+	}
+	word := make([]byte, 8)
+	var rDebug uint64
+	for addr := exe.base + exe.dynamic; ; addr += 16 {
+		if _, err := d.tracee.Peek(th.tid, uintptr(addr), word); err != nil {
+			return err
+		}
+		tag := binary.LittleEndian.Uint64(word)
+		if tag == uint64(elf.DT_NULL) {
+			return nil
+		}
+		if tag == uint64(elf.DT_DEBUG) {
+			if _, err := d.tracee.Peek(th.tid, uintptr(addr+8), word); err != nil {
+				return err
+			}
+			rDebug = binary.LittleEndian.Uint64(word)
+			break
+		}
+	}
+	if rDebug == 0 {
+		// Not initialized yet
+		return nil
+	}
+
+	if _, err := d.tracee.Peek(th.tid, uintptr(rDebug+16), word); err != nil { // r_brk
+		return err
+	}
+	hook := binary.LittleEndian.Uint64(word)
+	code := make([]byte, 5)
+	if _, err := d.tracee.Peek(th.tid, uintptr(hook), code); err != nil {
+		return err
+	}
+	if bytes.Equal(code[:4], []byte{0xF3, 0x0F, 0x1E, 0xFA}) { // ENDBR64
+		hook += 4
+		code = code[4:]
+	}
+	switch code[0] {
+	case 0xC3:
+		if _, err := d.tracee.Poke(th.tid, uintptr(hook), []byte{0xCC}); err != nil {
+			return err
+		}
+	case 0xCC:
+		// Inherited from the parent process
+	default:
+		return nil
+	}
+	th.proc.debugHook = hook
+	return nil
+}
+
+// Handle a stop at the breakpoint in the debug hook of the dynamic loader by updating the libraries
+// Unloaded libraries are pending again, so the system calls are traced until they are loaded anew.
+// Returns false, if the thread didn't stop at the debug hook.
+func (d *dispatcher) debugState(th *thread) (bool, error) {
+	if th.proc.debugHook == 0 {
+		return false, nil
+	}
+	if err := d.tracee.GetRegs(th.tid, &th.regs); err != nil {
+		return false, err
+	}
+	if th.regs.Rip-1 != th.proc.debugHook {
+		return false, nil
+	}
+
+	// Perform the return replaced by the breakpoint
+	word := make([]byte, 8)
+	if _, err := d.tracee.Peek(th.tid, uintptr(th.regs.Rsp), word); err != nil {
+		return true, err
+	}
+	th.regs.Rip = binary.LittleEndian.Uint64(word)
+	th.regs.Rsp += 8
+	if err := d.tracee.SetRegs(th.tid, &th.regs); err != nil {
+		return true, err
+	}
+	return true, d.updateLibraries(th)
+}
+
+// Handle an exec of a traced process
+// If the process executes the obfuscated binary again, we prepare the new image.
+// Otherwise we detach, since the new image doesn't contain any breakpoints.
+// Returns whether the process is still traced.
+func (d *dispatcher) exec(th *thread) (bool, error) {
+	// An exec kills all other threads of the process
+	for tid, other := range d.threads {
+		if other.proc == th.proc && other != th {
+			delete(d.threads, tid)
+		}
+	}
+
+	if exe, err := d.tracee.Executable(th.proc.pid); err == nil && os.SameFile(exe, d.modules[0].file) {
+		return true, d.prepare(th)
+	}
+
+	if err := d.scrubLibraryPath(th); err != nil {
+		log.Println("can't remove the obfuscated libraries from LD_LIBRARY_PATH:", err)
+	}
+	if err := d.tracee.Detach(th.tid); err != nil {
+		return false, err
+	}
+	delete(d.threads, th.tid)
+	delete(d.processes, th.proc.pid)
+	return false, nil
+}
+
+// Remove the directory of the obfuscated libraries from LD_LIBRARY_PATH of a process, which executed another binary
+// Otherwise, the untraced process would load an obfuscated library with the same soname and crash at its first trap.
+// At the exec stop, the dynamic loader didn't run yet and the stack pointer points to argc, followed by argv and envp.
+// The variable becomes shorter, so it's rewritten in place.
+func (d *dispatcher) scrubLibraryPath(th *thread) error {
+	if d.libDir == "" {
+		return nil
+	}
+	var regs syscall.PtraceRegs
+	if err := d.tracee.GetRegs(th.tid, &regs); err != nil {
+		return err
+	}
+	word := make([]byte, 8)
+	if _, err := d.tracee.Peek(th.tid, uintptr(regs.Rsp), word); err != nil {
+		return err
+	}
+	const name = "LD_LIBRARY_PATH="
+	for envp := regs.Rsp + 8*(binary.LittleEndian.Uint64(word)+2); ; envp += 8 {
+		if _, err := d.tracee.Peek(th.tid, uintptr(envp), word); err != nil {
+			return err
+		}
+		addr := binary.LittleEndian.Uint64(word)
+		if addr == 0 {
+			return nil
+		}
+		variable, err := d.readString(th.tid, addr)
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(variable, name) {
+			continue
+		}
+		var paths []string
+		for _, path := range strings.Split(strings.TrimPrefix(variable, name), ":") {
+			if path != d.libDir {
+				paths = append(paths, path)
+			}
+		}
+		if _, err := d.tracee.Write(th.tid, uintptr(addr), []byte(name+strings.Join(paths, ":")+"\x00")); err != nil {
+			return err
+		}
+	}
+}
+
+// Read a null-terminated string from the memory of the process containing thread tid
+func (d *dispatcher) readString(tid int, addr uint64) (string, error) {
+	var s []byte
+	chunk := make([]byte, 64)
+	for {
+		// The end of the chunk might not be mapped
+		n, err := d.tracee.Peek(tid, uintptr(addr)+uintptr(len(s)), chunk)
+		if n <= 0 {
+			return "", err
+		}
+		if i := bytes.IndexByte(chunk[:n], 0); i >= 0 {
+			return string(append(s, chunk[:i]...)), nil
+		}
+		s = append(s, chunk[:n]...)
+	}
+}
 
-	// Determine .text section offset
-	f, err := elf.Open(obfFdPath)
+// Determine the runtime addresses of the modules in a process
+// The binary needs to be mapped, while libraries, which aren't mapped completely yet, are skipped.
+func (d *dispatcher) mapModules(p *process) error {
+	sections, err := d.tracee.Sections(p.pid)
 	if err != nil {
-		log.Fatalln("can't read binary:", err)
+		return err
+	}
+	if p.modules == nil {
+		p.modules = make([]*mappedModule, len(d.modules))
 	}
-	entrypoint := f.Section(".text").Offset
-	_ = f.Close()
 
-	// Start execution with PTRACE_TRACEME
-	tracee, err := ptrace.Exec(obfFdPath, os.Args)
-	if err != nil {
-		log.Fatalln("can't exec binary:", err)
+	for i, m := range d.modules {
+		if i == 0 && p.modules[i] != nil {
+			// The binary stays in place until the next exec
+			continue
+		}
+		var loadBase uint64
+		var mapped bool
+		if i == 0 {
+			loadBase, mapped = d.loadBase(p.pid, m, sections)
+		} else {
+			loadBase, mapped = libraryLoadBase(m, sections)
+		}
+		var mm *mappedModule
+		if mapped {
+			mm, mapped = mapRegions(m, loadBase, sections)
+		}
+		if !mapped && i == 0 {
+			return fmt.Errorf("binary isn't mapped executable in process %v", p.pid)
+		}
+		if p.modules[i] == nil || mm == nil || p.modules[i].base != mm.base {
+			p.modules[i] = mm
+		}
 	}
+	return nil
+}
 
-	ev := tracee.Events()
-	start := false
+// Determine the runtime addresses of all code regions of a module
+// Returns false, if not all of them are mapped executable.
+func mapRegions(m *module, loadBase uint64, sections []*ptrace.SectionInfo) (*mappedModule, bool) {
+	mm := &mappedModule{module: m, base: loadBase, regions: make([]mappedRegion, len(m.regions))}
+	for i, region := range m.regions {
+		mm.regions[i] = mappedRegion{Region: region, start: loadBase + region.Addr}
+		mapped := false
+		for _, section := range sections {
+			end := mm.regions[i].start + region.Size - 1
+			if section.Flags&(1<<2) != 0 && section.StartAddr <= mm.regions[i].start && end <= section.EndAddr {
+				mapped = true
+				break
+			}
+		}
+		if !mapped {
+			return nil, false
+		}
+	}
+	return mm, true
+}
 
-	// Find start of .text section
-	// This method might not work if you manually change your segments and sections in some strange ways
-	execSection, _ := tracee.FirstExecSection()
-	textBaseAddr := execSection.StartAddr + entrypoint - execSection.Offset
+// Determine the load base of the obfuscated binary in process pid
+// The kernel passes the entry point of the program in the auxiliary vector. For position-independent
+// executables it is shifted by the load base. If it isn't available, we search the memory map for the binary.
+func (d *dispatcher) loadBase(pid int, m *module, sections []*ptrace.SectionInfo) (uint64, bool) {
+	if auxv, err := d.tracee.Auxv(pid); err == nil {
+		if entry, exists := auxv[9]; exists { // 9 = AT_ENTRY
+			return entry - m.entry, true
+		}
+	}
+	return libraryLoadBase(m, sections)
+}
 
-	// END of startup phase
+// Determine the load base of a module by searching the memory map for its in-memory file
+func libraryLoadBase(m *module, sections []*ptrace.SectionInfo) (uint64, bool) {
+	inode := strconv.FormatUint(m.file.Sys().(*syscall.Stat_t).Ino, 10)
+	for _, section := range sections {
+		if section.Inode == inode && section.Offset == 0 {
+			return section.StartAddr - m.firstVaddr, true
+		}
+	}
+	return 0, false
+}
 
-	// BEGIN operation phase
+// Create an in-memory file containing an obfuscated module
+// Returns the module and the path of the file.
+func createModule(contents []byte, metadata common.ExportMetadata) (*module, string, error) {
+	name, _ := syscall.BytePtrFromString(metadata.Name)
+	fd, _, errno := syscall.Syscall(319, uintptr(unsafe.Pointer(name)), 0, 0) // 319 = memfd_create
+	if errno != 0 {
+		return nil, "", errno
+	}
+	if _, err := syscall.Write(int(fd), contents); err != nil {
+		return nil, "", err
+	}
+	// Other processes need to be able to open the libraries
+	path := fmt.Sprintf("/proc/%d/fd/%d", os.Getpid(), fd)
 
-	for {
-		// Wait for the tracee to pause
-		e := <-ev
-		status := e.(syscall.WaitStatus)
-		if status.Exited() {
+	m := &module{
+		name:     metadata.Name,
+		regions:  metadata.Regions,
+		metadata: common.NewInstructionStore(metadata.Instructions),
+	}
+	var err error
+	if m.file, err = os.Stat(path); err != nil {
+		return nil, "", err
+	}
+
+	// Determine where the module expects to be loaded
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+	m.entry = f.Entry
+	for _, prog := range f.Progs {
+		if prog.Type == elf.PT_LOAD {
+			m.firstVaddr = (prog.Vaddr - prog.Off) &^ 0xfff
 			break
 		}
-		if status.StopSignal() != syscall.SIGTRAP {
-			log.Fatalf("unexpected status: %v", status.StopSignal())
+	}
+	for _, prog := range f.Progs {
+		if prog.Type == elf.PT_DYNAMIC {
+			m.dynamic = prog.Vaddr
 		}
-		var regs syscall.PtraceRegs
-		if err := tracee.GetRegs(&regs); err != nil {
-			log.Fatalln("can't read regs:", err)
+	}
+	return m, path, nil
+}
+
+// Helper function decrypting and deserializing the metadata
+// The first entry describes the binary, the remaining ones the libraries.
+func readMetadata(p *payload.Payload) ([]common.ExportMetadata, error) {
+	encoded, err := payload.Open(p.Metadata, p.Binary, p.Libraries)
+	if err != nil {
+		return nil, err
+	}
+	metadataRaw, err := common.DecodeMetadata(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(metadataRaw) != len(p.Libraries)+1 {
+		return nil, fmt.Errorf("metadata describes %d modules, but %d are packed", len(metadataRaw), len(p.Libraries)+1)
+	}
+	return metadataRaw, nil
+}
+
+// Helper function setting all the breakpoints in the tracee's memory as indicated by the metadata
+// Each breakpoint is one of the encodings of the trap chosen for the instruction.
+func setBreakpoints(tracee *ptrace.Tracee, tid int, m *mappedModule) error {
+	for _, inst := range m.metadata.Instructions() {
+		if _, err := tracee.Poke(tid, uintptr(m.runtimeAddr(inst.Addr, inst.Region)), trapCode(inst.Trap)); err != nil {
+			return err
 		}
+	}
 
-		// Handler
-		if !start {
-			// The first "pause" is not a breakpoint, but cause by PTRACE_TRACEME
-			// It allows us to prepare the binary with breakpoints
-			start = true
-			if err := setBreakpoints(tracee, textBaseAddr, metadata); err != nil {
-				log.Fatalln("can't set breakpoints:", err)
-			}
-		} else {
-			// All further pauses are caused by a breakpoint
-			// Thus, we perform the original instruction as indicated in the metadata
-			if err := performOriginalInstruction(tracee, textBaseAddr, metadata); err != nil {
-				log.Fatalln("can't perform original instruction:", err)
+	return nil
+}
+
+// Choose one of the encodings of a trap randomly
+func trapCode(trap common.Trap) []byte {
+	codes := trap.Codes()
+	return codes[rand.Intn(len(codes))]
+}
+
+// Count the hit of an obfuscated instruction and restore it, if it's hot
+func (d *dispatcher) hit(th *thread, m *mappedModule, inst common.ObfuscatedInstruction) error {
+	if d.profile == nil {
+		return nil
+	}
+	site := profile.Site{Module: m.name, Addr: inst.Addr}
+	hits := d.profile.Hit(site)
+	if d.hot == nil {
+		return nil
+	}
+	code, restorable := assemble(inst.Semantics)
+	addr := m.runtimeAddr(inst.Addr, inst.Region)
+	if !restorable || !replaceable(addr, inst.Trap) {
+		return nil
+	}
+
+	// Sites restored in another process or before an exec are restored right away
+	restore := d.hot.Restored(site)
+	if !restore {
+		var exchanged *profile.Site
+		restore, exchanged = d.hot.Decide(site, hits)
+		if exchanged != nil {
+			if err := d.obfuscateAgain(th, *exchanged); err != nil {
+				return err
 			}
 		}
-		if err := tracee.Continue(); err != nil {
-			log.Fatalln("can't continue tracee:", err)
-		}
 	}
-
-	if err := tracee.Close(); err != nil {
-		log.Fatalln("can't close tracee:", err)
+	if restore {
+		// Other threads keep running, so the trap is replaced last. Until then, they still stop at it.
+		trapLen := int(inst.Trap.Len())
+		if _, err := d.tracee.Poke(th.tid, uintptr(addr)+uintptr(trapLen), code[trapLen:]); err != nil {
+			return err
+		}
+		if _, err := d.tracee.Poke(th.tid, uintptr(addr), code[:trapLen]); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
+// Check whether the trap at addr can be replaced at once
+// Memory is written one word at a time, so a trap spanning two words would be half replaced in between.
+func replaceable(addr uint64, trap common.Trap) bool {
+	return addr/8 == (addr+uint64(trap.Len())-1)/8
 }
 
-// Helper function deserializing the metadata json
-func readMetadata() (map[uint64]common.ObfuscatedInstruction, error) {
-	var metadataRaw []common.ExportObfuscatedInstruction
-	if err := json.Unmarshal(bin.Meta, &metadataRaw); err != nil {
-		return nil, err
+// Replace a restored instruction in the process of thread th with its trap followed by random data
+func (d *dispatcher) obfuscateAgain(th *thread, site profile.Site) error {
+	for _, m := range th.proc.modules {
+		if m == nil || m.name != site.Module {
+			continue
+		}
+		inst, exists, err := m.metadata.Lookup(site.Addr)
+		if err != nil || !exists {
+			return err
+		}
+		// The trap is written first, so other threads stop at it before the original instruction is overwritten
+		addr := uintptr(m.runtimeAddr(inst.Addr, inst.Region))
+		trap := trapCode(inst.Trap)
+		if _, err := d.tracee.Poke(th.tid, addr, trap); err != nil {
+			return err
+		}
+		code := make([]byte, int(inst.Semantics.Len)-len(trap))
+		_, _ = rand.Read(code)
+		_, err = d.tracee.Poke(th.tid, addr+uintptr(len(trap)), code)
+		return err
 	}
+	return nil
+}
 
-	m, err := common.ImportObfuscatedInstructions(metadataRaw)
+// Record a handled breakpoint in the trace, if enabled
+// The target is the instruction pointer after performing the instruction. If writing fails, tracing stops.
+func (d *dispatcher) record(th *thread, m *mappedModule, addr uint64, kind common.Kind, taken bool) {
+	if d.trace == nil {
+		return
+	}
+	err := d.trace.Record(trace.Event{Tid: th.tid, Module: m.name, Addr: addr, Kind: kind, Taken: taken, Target: th.regs.Rip})
 	if err != nil {
-		return nil, err
+		log.Println("can't write trace:", err)
+		_ = d.trace.Close()
+		d.trace = nil
 	}
+}
 
-	return m, nil
+// Write the profile and the report of the hot-branch restoration, if requested
+func (d *dispatcher) writeProfile() {
+	if profileFile != "" {
+		if err := d.profile.Write(profileFile); err != nil {
+			log.Println("can't write profile:", err)
+		}
+	}
+	if d.hot != nil && hotReport != "" {
+		sites := 0
+		for _, m := range d.modules {
+			sites += len(m.metadata.Instructions())
+		}
+		w := os.Stderr
+		if hotReport != "-" {
+			f, err := os.Create(hotReport)
+			if err != nil {
+				log.Println("can't write report:", err)
+				return
+			}
+			defer f.Close()
+			w = f
+		}
+		d.hot.Report(w, d.profile, sites)
+	}
 }
 
-// Helper function setting all the breakpoints in the tracee's memory as indicated by the metadata
-func setBreakpoints(tracee *ptrace.Tracee, textBaseAddr uint64, metadata map[uint64]common.ObfuscatedInstruction) error {
-	breakpoint := []byte{0xCC}
-	for _, inst := range metadata {
-		if _, err := tracee.Poke(uintptr(textBaseAddr+inst.Offset), breakpoint); err != nil {
-			return err
+// Assemble the original instruction from its semantics
+// Only direct jumps, calls, returns and loops can be assembled. Shorter encodings are padded with
+// DS segment prefixes, which are ignored in 64 bit mode, so the instruction keeps its length.
+// Calls and returns aren't restored with a shadow stack, as it would get out of sync.
+func assemble(sem common.Semantics) ([]byte, bool) {
+	// Condition codes of Jcc
+	cc := map[common.Cond]byte{
+		common.CondO: 0x0, common.CondNO: 0x1, common.CondB: 0x2, common.CondAE: 0x3,
+		common.CondE: 0x4, common.CondNE: 0x5, common.CondBE: 0x6, common.CondA: 0x7,
+		common.CondS: 0x8, common.CondNS: 0x9, common.CondP: 0xa, common.CondNP: 0xb,
+		common.CondL: 0xc, common.CondGE: 0xd, common.CondLE: 0xe, common.CondG: 0xf,
+	}
+	arg := sem.Args[0]
+	rel8 := arg.Kind == common.OperandRel && arg.Imm == int64(int8(arg.Imm))
+
+	var code []byte
+	switch {
+	case sem.Kind == common.KindRet && !shadowStack:
+		if arg.Kind == common.OperandImm {
+			code = []byte{0xC2, byte(arg.Imm), byte(arg.Imm >> 8)}
+		} else {
+			code = []byte{0xC3}
 		}
+	case arg.Kind != common.OperandRel:
+		return nil, false
+	case sem.Kind == common.KindCall && !shadowStack:
+		code = append([]byte{0xE8}, rel32(arg.Imm)...)
+	case sem.Kind == common.KindJump && sem.Cond == common.CondAlways:
+		if rel8 {
+			code = []byte{0xEB, byte(arg.Imm)}
+		} else {
+			code = append([]byte{0xE9}, rel32(arg.Imm)...)
+		}
+	case sem.Kind == common.KindJump && sem.Cond == common.CondCXZ:
+		// JCXZ can't be encoded in 64 bit mode
+		if !rel8 || sem.AddrSize == 16 {
+			return nil, false
+		}
+		code = []byte{0xE3, byte(arg.Imm)}
+	case sem.Kind == common.KindJump:
+		if rel8 {
+			code = []byte{0x70 | cc[sem.Cond], byte(arg.Imm)}
+		} else {
+			code = append([]byte{0x0F, 0x80 | cc[sem.Cond]}, rel32(arg.Imm)...)
+		}
+	case sem.Kind == common.KindLoop:
+		if !rel8 {
+			return nil, false
+		}
+		code = []byte{map[common.Cond]byte{common.CondAlways: 0xE2, common.CondE: 0xE1, common.CondNE: 0xE0}[sem.Cond], byte(arg.Imm)}
+	default:
+		return nil, false
 	}
 
-	return nil
+	// The counter of JECXZ and the LOOPs with 32 bit address size is ECX
+	if (sem.Kind == common.KindLoop || sem.Cond == common.CondCXZ) && sem.AddrSize == 32 {
+		code = append([]byte{0x67}, code...)
+	}
+	if len(code) > int(sem.Len) {
+		return nil, false
+	}
+	padding := make([]byte, int(sem.Len)-len(code))
+	for i := range padding {
+		padding[i] = 0x3E
+	}
+	return append(padding, code...), true
+}
+
+// Helper function encoding a 32 bit displacement
+func rel32(rel int64) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, uint32(rel))
+	return b
 }
 
 // Some flags
@@ -160,278 +1384,424 @@ func parseEflags(flags uint64) Eflags {
 	}
 }
 
-// Search the metadata for the original instruction and perform it manually
-func performOriginalInstruction(tracee *ptrace.Tracee, textBaseAddr uint64, metadata map[uint64]common.ObfuscatedInstruction) error {
+// Evaluate the condition of an instruction based on the flags and the counter register
+func condition(cond common.Cond, addrSize uint8, regs *syscall.PtraceRegs) bool {
+	eflags := parseEflags(regs.Eflags)
+	switch cond {
+	case common.CondAlways:
+		return true
+	case common.CondO:
+		return eflags.OF
+	case common.CondNO:
+		return !eflags.OF
+	case common.CondS:
+		return eflags.SF
+	case common.CondNS:
+		return !eflags.SF
+	case common.CondE:
+		return eflags.ZF
+	case common.CondNE:
+		return !eflags.ZF
+	case common.CondB:
+		return eflags.CF
+	case common.CondAE:
+		return !eflags.CF
+	case common.CondBE:
+		return eflags.CF || eflags.ZF
+	case common.CondA:
+		return !eflags.CF && !eflags.ZF
+	case common.CondL:
+		return eflags.SF != eflags.OF
+	case common.CondGE:
+		return eflags.SF == eflags.OF
+	case common.CondLE:
+		return eflags.ZF || eflags.SF != eflags.OF
+	case common.CondG:
+		return !eflags.ZF && eflags.SF == eflags.OF
+	case common.CondP:
+		return eflags.PF
+	case common.CondNP:
+		return !eflags.PF
+	case common.CondCXZ:
+		switch addrSize {
+		case 16:
+			return regs.Rcx&0xffff == 0
+		case 32:
+			return regs.Rcx&0xffffffff == 0
+		}
+		return regs.Rcx == 0
+	}
+	return false
+}
+
+// Search the metadata for the original instruction and perform it manually in the stopped thread
+// The signal the thread stopped with tells, whether the trap faulted. Only traps reported with this signal match.
+func (d *dispatcher) performOriginalInstruction(th *thread, sig syscall.Signal) error {
+	tracee := d.tracee
+
 	// Get registers
-	var regs syscall.PtraceRegs
-	if err := tracee.GetRegs(&regs); err != nil {
+	if err := tracee.GetRegs(th.tid, &th.regs); err != nil {
 		return err
 	}
+	regs := &th.regs
 
-	offset := regs.Rip - textBaseAddr - 1 // RIP already points to next instruction (after the breakpoint) right now
+	// Unless the trap faulted, RIP already points to the next instruction (after the trap) right now
+	site := regs.Rip
+	if sig == syscall.SIGTRAP {
+		site--
+	}
+	m, addr, inRegion := th.proc.elfAddr(site)
 
 	// Search metadata
-	inst, exists := metadata[offset]
-	if exists {
-		eflags := parseEflags(regs.Eflags)
+	var inst common.ObfuscatedInstruction
+	exists := false
+	if inRegion {
+		var err error
+		if inst, exists, err = m.metadata.Lookup(addr); err != nil {
+			return err
+		}
+	}
+	if exists && inst.Trap.Signal() == sig {
+		d.history.Add(crash.Breakpoint{Tid: th.tid, Module: m.name, Addr: crash.Hex(addr), Rip: crash.Hex(site)})
+		regs.Rip = site
+		if err := d.hit(th, m, inst); err != nil {
+			return err
+		}
+		sem := inst.Semantics
 
-		// Check whether we need to jump or not
+		// Check whether we need to jump or not and perform the instruction
 		var cond bool
-		call := false
-		switch inst.Inst.Op {
-		case x86asm.JMP:
-			cond = true
-			break
-		case x86asm.JO:
-			cond = eflags.OF
-			break
-		case x86asm.JNO:
-			cond = !eflags.OF
-			break
-		case x86asm.JS:
-			cond = eflags.SF
-			break
-		case x86asm.JNS:
-			cond = !eflags.SF
-			break
-		case x86asm.JE:
-			cond = eflags.ZF
-			break
-		case x86asm.JNE:
-			cond = !eflags.ZF
-			break
-		case x86asm.JB:
-			cond = eflags.CF
-			break
-		case x86asm.JAE:
-			cond = !eflags.CF
-			break
-		case x86asm.JBE:
-			cond = eflags.CF || eflags.ZF
-			break
-		case x86asm.JA:
-			cond = !eflags.CF && !eflags.ZF
-			break
-		case x86asm.JL:
-			cond = eflags.SF != eflags.OF
-			break
-		case x86asm.JGE:
-			cond = eflags.SF == eflags.OF
-			break
-		case x86asm.JLE:
-			cond = eflags.ZF || eflags.SF != eflags.OF
-			break
-		case x86asm.JG:
-			cond = !eflags.ZF && eflags.SF == eflags.OF
-			break
-		case x86asm.JP:
-			cond = eflags.PF
-			break
-		case x86asm.JNP:
-			cond = !eflags.PF
-			break
-		case x86asm.JRCXZ:
-			cond = regs.Rcx == 0
-			break
-		case x86asm.JECXZ:
-			cond = regs.Rcx&0xffffffff == 0
-			break
-		case x86asm.JCXZ:
-			cond = regs.Rcx&0xffff == 0
-			break
-		case x86asm.CALL:
+		var err error
+		switch sem.Kind {
+		case common.KindJump, common.KindCall:
+			cond = condition(sem.Cond, sem.AddrSize, regs)
+			err = condJump(cond, tracee, th, sem, sem.Kind == common.KindCall)
+		case common.KindLoop:
+			// The counter is decremented before the condition is evaluated
+			cond = decrementCounter(regs, sem.AddrSize) != 0 && condition(sem.Cond, sem.AddrSize, regs)
+			err = condJump(cond, tracee, th, sem, false)
+		case common.KindRet:
 			cond = true
-			call = true
-			break
+			err = ret(tracee, th, sem)
+		case common.KindMove:
+			cond = condition(sem.Cond, sem.AddrSize, regs)
+			err = conditionalMove(tracee, th, sem, cond)
+		case common.KindSet:
+			cond = condition(sem.Cond, sem.AddrSize, regs)
+			err = conditionalSet(tracee, th, sem, cond)
 		default:
 			// We should never land here, as this means, that the Obfuscator replaced an instruction, that we don't know
-			log.Fatalln("Unknown instruction:", inst.Inst)
-		}
-
-		// Perform the instruction
-		return condJump(cond, tracee, regs, inst.Inst, call)
-	}
-
-	// ERROR CASE
-	//   When we are here, the program stopped at an unknown offset
-	//   Uncomment the following lines to print debug information
-	//for _, inst := range metadata {
-	//	o := 0x200 + inst.Offset - offset
-	//	if o < 0x400 {
-	//		log.Printf("Offsets not matching: 0x%06x <-> 0x%06x", inst.Offset, offset)
-	//	}
-	//}
-	//log.Printf("RIP: 0x%012x", regs.Rip)
-	//mem := make([]byte, 0x40)
-	//n, err := tracee.Peek(uintptr(regs.Rip-0x20), mem)
-	//if err != nil {
-	//	log.Print(n)
-	//} else {
-	//	for i, b := range mem {
-	//		if i >= n {
-	//			break
-	//		}
-	//		fmt.Printf("%02x ", b)
-	//	}
-	//	fmt.Println()
-	//}
-	log.Fatal("No matching offset found")
-	return nil
+			return fmt.Errorf("%w: %v", errUnknownInstruction, sem)
+		}
+		if err == nil {
+			d.record(th, m, addr, sem.Kind, cond)
+		}
+		return err
+	}
+
+	// The program stopped at an unknown offset, which is described by the crash report
+	return errNoMatchingOffset
+}
+
+// Helper function decrementing the counter register of the LOOP instructions
+// Depending on the address size, the counter is either RCX or ECX. The flags are not affected.
+func decrementCounter(regs *syscall.PtraceRegs, addrSize uint8) uint64 {
+	if addrSize == 32 {
+		regs.Rcx = uint64(uint32(regs.Rcx) - 1)
+	} else {
+		regs.Rcx--
+	}
+	return regs.Rcx
 }
 
 // Helper function
 //   If cond == true, then depending on isCall a jump or call is performed,
 //      i.e. the operand of the instruction is evaluated
-//   If cond == false, the instruction pointer might still be need to be increased,
-//      since the breakpoint has instruction length 1, while the original instruction
-//		is most likely a bit longer
-func condJump(condition bool, tracee *ptrace.Tracee, regs syscall.PtraceRegs, inst x86asm.Inst, isCall bool) error {
-	regs.Rip += uint64(inst.Len - 1)
+//   In both cases, the instruction pointer is moved from the trap to the next instruction,
+//      since the trap is usually shorter than the original instruction
+func condJump(condition bool, tracee *ptrace.Tracee, th *thread, sem common.Semantics, isCall bool) error {
+	regs := &th.regs
+	next := regs.Rip + uint64(sem.Len)
+
+	// The operand is evaluated before the return address is pushed, as it might be relative to RSP
+	var target uint64
+	if condition {
+		var err error
+		if target, err = jumpTarget(tracee, th, sem, next); err != nil {
+			return fmt.Errorf("can't perform %v: %v", sem, err)
+		}
+	}
+
+	regs.Rip = next
 	if isCall {
 		// For a call, we need to push the return address onto the stack
 		regs.Rsp -= 8
 		returnAddress := make([]byte, 8)
 		binary.LittleEndian.PutUint64(returnAddress, regs.Rip)
-		if n, err := tracee.Poke(uintptr(regs.Rsp), returnAddress); n != 8 || err != nil {
+		if n, err := tracee.Poke(th.tid, uintptr(regs.Rsp), returnAddress); n != 8 || err != nil {
 			return err
 		}
+		if shadowStack {
+			th.shadow.push(regs.Rsp, regs.Rip)
+		}
+	}
+	if condition {
+		regs.Rip = target
+	}
+	return tracee.SetRegs(th.tid, regs)
+}
+
+// Helper function computing the target of a jump or call
+// next is the address of the instruction following the original one.
+func jumpTarget(tracee *ptrace.Tracee, th *thread, sem common.Semantics, next uint64) (uint64, error) {
+	// Consider the different operand types
+	switch arg := sem.Args[0]; arg.Kind {
+	case common.OperandRel:
+		return jumpRel(next, arg.Imm), nil
+	case common.OperandImm:
+		return jumpImm(arg.Imm)
+	case common.OperandMem:
+		return jumpMem(tracee, th, arg, sem.AddrSize, next)
+	case common.OperandReg:
+		return jumpReg(th, arg.Reg)
+	}
+	return 0, fmt.Errorf("can't decode argument %v", sem.Args[0])
+}
+
+// Helper function for performing returns
+// The return address is popped from the stack. The immediate operand of RET imm16
+// specifies the number of additional bytes to release.
+func ret(tracee *ptrace.Tracee, th *thread, sem common.Semantics) error {
+	regs := &th.regs
+	returnAddress := make([]byte, 8)
+	if n, err := tracee.Peek(th.tid, uintptr(regs.Rsp), returnAddress); n != 8 || err != nil {
+		return fmt.Errorf("can't fetch return address: n: %v, err: %v", n, err)
+	}
+	target := binary.LittleEndian.Uint64(returnAddress)
+	if shadowStack && !th.shadow.pop(regs.Rsp, target) {
+		return fmt.Errorf("%w: 0x%x at 0x%x", errShadowStack, target, regs.Rsp)
+	}
+
+	regs.Rsp += 8
+	if sem.Args[0].Kind == common.OperandImm {
+		regs.Rsp += uint64(sem.Args[0].Imm)
+	}
+	regs.Rip = target
+	return tracee.SetRegs(th.tid, regs)
+}
+
+// Helper function emulating conditional moves
+// The destination is always written, since a 32 bit destination is zero-extended even if the condition is false
+func conditionalMove(tracee *ptrace.Tracee, th *thread, sem common.Semantics, condition bool) error {
+	regs := &th.regs
+	regs.Rip += uint64(sem.Len)
+	if sem.Args[0].Kind != common.OperandReg {
+		return fmt.Errorf("can't decode destination of instruction %v", sem)
+	}
+	dst := sem.Args[0].Reg
+	val, err := readReg(dst, regs)
+	if err != nil {
+		return err
 	}
 
 	if condition {
-		// Consider the different operand types
-		arg := inst.Args[0]
-		if rel, isRel := arg.(x86asm.Rel); isRel {
-			return jumpRel(tracee, regs, rel)
-		} else if imm, isImm := arg.(x86asm.Imm); isImm {
-			return jumpImm(tracee, regs, imm)
-		} else if mem, isMem := arg.(x86asm.Mem); isMem {
-			return jumpMem(tracee, regs, mem)
-		} else if reg, isReg := arg.(x86asm.Reg); isReg {
-			return jumpReg(tracee, regs, reg)
-		} else {
-			return fmt.Errorf("can't decode argument of instruction %v", inst)
+		switch src := sem.Args[1]; src.Kind {
+		case common.OperandReg:
+			if val, err = readReg(src.Reg, regs); err != nil {
+				return err
+			}
+		case common.OperandMem:
+			addr, err := effectiveAddress(src.Mem, regs, sem.AddrSize, regs.Rip)
+			if err != nil {
+				return err
+			}
+			data := make([]byte, 8)
+			if n, err := tracee.Peek(th.tid, uintptr(addr), data[:src.Size]); n != int(src.Size) || err != nil {
+				return fmt.Errorf("can't fetch source operand %v: n: %v, err: %v", src.Mem, n, err)
+			}
+			val = binary.LittleEndian.Uint64(data)
+		default:
+			return fmt.Errorf("can't decode source of instruction %v", sem)
 		}
-	} else {
-		return dontJump(tracee, regs)
 	}
+
+	if err := writeReg(dst, val, regs); err != nil {
+		return err
+	}
+	return tracee.SetRegs(th.tid, regs)
 }
 
-// Helper function for the case, that we don't perform the jump
-func dontJump(tracee *ptrace.Tracee, regs syscall.PtraceRegs) error {
-	return tracee.SetRegs(&regs)
+// Helper function emulating conditional sets
+func conditionalSet(tracee *ptrace.Tracee, th *thread, sem common.Semantics, condition bool) error {
+	regs := &th.regs
+	regs.Rip += uint64(sem.Len)
+	var val byte
+	if condition {
+		val = 1
+	}
+
+	switch dst := sem.Args[0]; dst.Kind {
+	case common.OperandReg:
+		if err := writeReg(dst.Reg, uint64(val), regs); err != nil {
+			return err
+		}
+	case common.OperandMem:
+		addr, err := effectiveAddress(dst.Mem, regs, sem.AddrSize, regs.Rip)
+		if err != nil {
+			return err
+		}
+		if n, err := tracee.Write(th.tid, uintptr(addr), []byte{val}); n != 1 || err != nil {
+			return fmt.Errorf("can't write destination operand %v: n: %v, err: %v", dst.Mem, n, err)
+		}
+	default:
+		return fmt.Errorf("can't decode destination of instruction %v", sem)
+	}
+	return tracee.SetRegs(th.tid, regs)
 }
 
 // Helper function for performing jumps with register operands
-func jumpReg(tracee *ptrace.Tracee, regs syscall.PtraceRegs, reg x86asm.Reg) error {
-	val, err := regValue(reg, regs)
+// Registers smaller than 64 bit are zero-extended.
+func jumpReg(th *thread, reg common.Reg) (uint64, error) {
+	val, err := readReg(reg, &th.regs)
 	if err != nil {
-		log.Fatal("Can't perform indirect register jump: invalid register ", reg.String())
+		return 0, fmt.Errorf("can't perform indirect register jump: invalid register %v", reg)
 	}
-	regs.Rip = val
-	return tracee.SetRegs(&regs)
+	return val, nil
 }
 
 // Helper function for performing jumps with memory operands
-func jumpMem(tracee *ptrace.Tracee, regs syscall.PtraceRegs, mem x86asm.Mem) error {
-	if mem.Segment != 0 {
-		// We currently don't support segment registers at all, since they don't seem to be used in x64
-		log.Fatal("Can't perform indirect memory jump: segment register not supported; Operand: ", mem.String())
-	}
-	addr, err := regValue(mem.Base, regs) // Base register
+// Targets smaller than 64 bit are zero-extended.
+func jumpMem(tracee *ptrace.Tracee, th *thread, arg common.Operand, addrSize uint8, next uint64) (uint64, error) {
+	mem := arg.Mem
+	addr, err := effectiveAddress(mem, &th.regs, addrSize, next)
 	if err != nil {
-		// Register can't be resolved. Should not happen
-		log.Fatal("Can't perform indirect memory jump: base register not supported; Operand: ", mem.String())
+		return 0, fmt.Errorf("can't perform indirect memory jump: %v", err)
+	}
+
+	// Dereference pointer
+	size := int(arg.Size)
+	if size == 0 || size > 8 {
+		size = 8
+	}
+	target := make([]byte, 8)
+	if n, err := tracee.Peek(th.tid, uintptr(addr), target[:size]); n != size || err != nil {
+		return 0, fmt.Errorf("can't perform indirect memory jump: can't fetch target address; Operand: %v; n: %v, err: %v", mem.String(), n, err)
+	}
+	return binary.LittleEndian.Uint64(target), nil
+}
+
+// Helper function computing the address of a memory operand
+// RIP-relative addresses are relative to next, the address of the instruction following the original one.
+// With an address size of 32 bit (address-size override prefix), the registers are 32 bit wide and the
+// address wraps around at 4 GiB. In 64 bit mode, only the FS and GS segments have a base address, which is
+// used for thread-local storage. It is added after the wraparound.
+func effectiveAddress(mem common.Memory, regs *syscall.PtraceRegs, addrSize uint8, next uint64) (uint64, error) {
+	var addr uint64
+	switch mem.Base {
+	case common.RegNone:
+		// Absolute address or scaled index only
+	case common.IP, common.EIP, common.RIP:
+		addr = next
+	default:
+		base, err := readReg(mem.Base, regs) // Base register
+		if err != nil {
+			// Register can't be resolved. Should not happen
+			return 0, fmt.Errorf("base register not supported; Operand: %v", mem.String())
+		}
+		addr = base
 	}
 	addr += uint64(mem.Disp) // Displacement
 
-	if mem.Index != 0 {
-		index, err := regValue(mem.Index, regs)
+	if mem.Index != common.RegNone {
+		index, err := readReg(mem.Index, regs)
 		if err != nil {
 			// Register can't be resolved. Should not happen
-			log.Fatal("Can't perform indirect memory jump: index register not supported; Operand: ", mem.String())
+			return 0, fmt.Errorf("index register not supported; Operand: %v", mem.String())
 		}
 		addr += index * uint64(mem.Scale) // Scale * Index
 	}
 
-	// Dereference pointer
-	target := make([]byte, 8)
-	if n, err := tracee.Peek(uintptr(addr), target); n != 8 || err != nil {
-		log.Fatalf("Can't perform indirect memory jump: can't fetch target address; Operand: %v; n: %v, err: %v", mem.String(), n, err)
+	switch addrSize {
+	case 16:
+		addr = uint64(uint16(addr))
+	case 32:
+		addr = uint64(uint32(addr))
 	}
-	regs.Rip = binary.LittleEndian.Uint64(target)
-	return tracee.SetRegs(&regs)
+
+	switch mem.Segment {
+	case common.RegNone, common.ES, common.CS, common.SS, common.DS:
+	case common.FS:
+		addr += regs.Fs_base
+	case common.GS:
+		addr += regs.Gs_base
+	default:
+		return 0, fmt.Errorf("segment register not supported; Operand: %v", mem.String())
+	}
+	return addr, nil
 }
 
 // Helper function for performing jumps with immediate operands
-func jumpImm(tracee *ptrace.Tracee, regs syscall.PtraceRegs, imm x86asm.Imm) error {
+func jumpImm(imm int64) (uint64, error) {
 	// Immediate operands don't exist for jumps and calls
-	log.Fatal("Can't perform immediate jump")
-	return nil
+	return 0, fmt.Errorf("can't perform immediate jump")
 }
 
 // Helper function for performing jumps with relative operands
-func jumpRel(tracee *ptrace.Tracee, regs syscall.PtraceRegs, rel x86asm.Rel) error {
-	regs.Rip = regs.Rip + uint64(rel)
-	return tracee.SetRegs(&regs)
-}
-
-// Helper function for translating a x86asm.Reg value to the entry of syscall.PtraceRegs
-func regValue(reg x86asm.Reg, regs syscall.PtraceRegs) (uint64, error) {
-	var val uint64
-	switch reg {
-	case x86asm.RAX:
-		val = regs.Rax
-		break
-	case x86asm.RBX:
-		val = regs.Rbx
-		break
-	case x86asm.RCX:
-		val = regs.Rcx
-		break
-	case x86asm.RDX:
-		val = regs.Rdx
-		break
-	case x86asm.RSP:
-		val = regs.Rsp
-		break
-	case x86asm.RBP:
-		val = regs.Rbp
-		break
-	case x86asm.RIP:
-		val = regs.Rip
-		break
-	case x86asm.RDI:
-		val = regs.Rdi
-		break
-	case x86asm.RSI:
-		val = regs.Rsi
-		break
-	case x86asm.R8:
-		val = regs.R8
-		break
-	case x86asm.R9:
-		val = regs.R9
-		break
-	case x86asm.R10:
-		val = regs.R10
-		break
-	case x86asm.R11:
-		val = regs.R11
-		break
-	case x86asm.R12:
-		val = regs.R12
-		break
-	case x86asm.R13:
-		val = regs.R13
-		break
-	case x86asm.R14:
-		val = regs.R14
-		break
-	case x86asm.R15:
-		val = regs.R15
-		break
+func jumpRel(next uint64, rel int64) uint64 {
+	return next + uint64(rel)
+}
+
+// Helper function locating a general purpose register of any size in syscall.PtraceRegs
+// Returns the 64 bit register containing it, the position of its lowest bit and its size in bytes
+func gpr(reg common.Reg, regs *syscall.PtraceRegs) (*uint64, uint, int, error) {
+	full := [...]*uint64{
+		&regs.Rax, &regs.Rcx, &regs.Rdx, &regs.Rbx, &regs.Rsp, &regs.Rbp, &regs.Rsi, &regs.Rdi,
+		&regs.R8, &regs.R9, &regs.R10, &regs.R11, &regs.R12, &regs.R13, &regs.R14, &regs.R15,
+	}
+	switch {
+	case reg >= common.AL && reg <= common.BL:
+		return full[reg-common.AL], 0, 1, nil
+	case reg >= common.AH && reg <= common.BH:
+		return full[reg-common.AH], 8, 1, nil
+	case reg >= common.SPB && reg <= common.R15B:
+		return full[reg-common.SPB+4], 0, 1, nil
+	case reg >= common.AX && reg <= common.R15W:
+		return full[reg-common.AX], 0, 2, nil
+	case reg >= common.EAX && reg <= common.R15L:
+		return full[reg-common.EAX], 0, 4, nil
+	case reg >= common.RAX && reg <= common.R15:
+		return full[reg-common.RAX], 0, 8, nil
+	}
+	return nil, 0, 0, fmt.Errorf("invalid register: %v", reg)
+}
+
+// Helper function reading a general purpose register of any size
+func readReg(reg common.Reg, regs *syscall.PtraceRegs) (uint64, error) {
+	full, shift, size, err := gpr(reg, regs)
+	if err != nil {
+		return 0, err
+	}
+	if size == 8 {
+		return *full, nil
+	}
+	return (*full >> shift) & (1<<(8*uint(size)) - 1), nil
+}
+
+// Helper function writing a general purpose register of any size
+// Like the processor, we zero-extend 32 bit values and keep the remaining bits for 8 and 16 bit values.
+func writeReg(reg common.Reg, val uint64, regs *syscall.PtraceRegs) error {
+	full, shift, size, err := gpr(reg, regs)
+	if err != nil {
+		return err
+	}
+	switch size {
+	case 8:
+		*full = val
+	case 4:
+		*full = val & 0xffffffff
 	default:
-		return val, fmt.Errorf("invalid register: %v", reg)
+		mask := uint64(1<<(8*uint(size))-1) << shift
+		*full = *full&^mask | (val<<shift)&mask
 	}
-	return val, nil
+	return nil
 }
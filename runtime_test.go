@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"github.com/BlobbyBob/PtraceObfuscator/common"
+	"syscall"
+	"testing"
+)
+
+// The runtime is a single file, run the tests with: go test runtime.go runtime_test.go
+
+func testRegs() *syscall.PtraceRegs {
+	return &syscall.PtraceRegs{
+		Rax:     0x1122334455667788,
+		Rbx:     0x00007ffc00001000,
+		Rcx:     3,
+		Rsp:     0x00007ffc0000fff0,
+		R8:      0xffffffffffffff80,
+		Fs_base: 0x00007f0000001000,
+		Gs_base: 0x00007f0000100000,
+	}
+}
+
+func TestEffectiveAddress(t *testing.T) {
+	const next = 0x401000
+	tests := []struct {
+		name     string
+		mem      common.Memory
+		addrSize uint8
+		setup    func(regs *syscall.PtraceRegs)
+		want     uint64
+	}{
+		{"base", common.Memory{Base: common.RBX}, 64, nil, 0x7ffc00001000},
+		{"negative disp8", common.Memory{Base: common.RBX, Disp: -8}, 64, nil, 0x7ffc00000ff8},
+		{"negative disp32", common.Memory{Base: common.RBX, Disp: -0x100}, 64, nil, 0x7ffc00000f00},
+		{"base and index", common.Memory{Base: common.RBX, Index: common.RCX, Scale: 8, Disp: 0x10}, 64, nil, 0x7ffc00001028},
+		{"no base", common.Memory{Index: common.RCX, Scale: 8, Disp: 0x1000}, 64, nil, 0x1018},
+		{"absolute", common.Memory{Disp: 0x601040}, 64, nil, 0x601040},
+		{"32 bit base", common.Memory{Base: common.EAX, Disp: 0x10}, 32, nil, 0x55667798},
+		{"32 bit wraparound", common.Memory{Base: common.EAX, Disp: 0x10}, 32,
+			func(regs *syscall.PtraceRegs) { regs.Rax = 0xdeadbeeffffffff8 }, 0x8},
+		{"32 bit negative index", common.Memory{Base: common.EBX, Index: common.R8L, Scale: 1, Disp: -4}, 32, nil, 0xf7c},
+		{"rip-relative", common.Memory{Base: common.RIP, Disp: -0x10}, 64, nil, 0x400ff0},
+		{"fs", common.Memory{Segment: common.FS, Scale: 1, Disp: -8}, 64, nil, 0x7f0000000ff8},
+		{"gs", common.Memory{Segment: common.GS, Base: common.RCX, Disp: 0x28}, 64, nil, 0x7f000010002b},
+		{"gs after wraparound", common.Memory{Segment: common.GS, Base: common.EAX, Disp: 0x10}, 32,
+			func(regs *syscall.PtraceRegs) { regs.Rax = 0xfffffff8 }, 0x7f0000100008},
+		{"ds", common.Memory{Segment: common.DS, Base: common.RBX}, 64, nil, 0x7ffc00001000},
+	}
+	for _, test := range tests {
+		regs := testRegs()
+		if test.setup != nil {
+			test.setup(regs)
+		}
+		got, err := effectiveAddress(test.mem, regs, test.addrSize, next)
+		if err != nil {
+			t.Errorf("%s: %v: %v", test.name, test.mem, err)
+		} else if got != test.want {
+			t.Errorf("%s: %v = %#x, want %#x", test.name, test.mem, got, test.want)
+		}
+	}
+}
+
+func TestEffectiveAddressInvalid(t *testing.T) {
+	for _, mem := range []common.Memory{
+		{Base: common.ES},
+		{Base: common.RBX, Index: common.FS, Scale: 1},
+		{Segment: common.RAX, Base: common.RBX},
+	} {
+		if got, err := effectiveAddress(mem, testRegs(), 64, 0); err == nil {
+			t.Errorf("%v = %#x, expected error", mem, got)
+		}
+	}
+}
+
+func TestReadReg(t *testing.T) {
+	tests := []struct {
+		reg  common.Reg
+		want uint64
+	}{
+		{common.AL, 0x88},
+		{common.AH, 0x77},
+		{common.AX, 0x7788},
+		{common.EAX, 0x55667788},
+		{common.RAX, 0x1122334455667788},
+		{common.CL, 3},
+		{common.SPB, 0xf0},
+		{common.R8B, 0x80},
+		{common.R8W, 0xff80},
+		{common.R8L, 0xffffff80},
+		{common.R8, 0xffffffffffffff80},
+	}
+	for _, test := range tests {
+		got, err := readReg(test.reg, testRegs())
+		if err != nil {
+			t.Errorf("%v: %v", test.reg, err)
+		} else if got != test.want {
+			t.Errorf("%v = %#x, want %#x", test.reg, got, test.want)
+		}
+	}
+	if _, err := readReg(common.RIP, testRegs()); err == nil {
+		t.Errorf("%v: expected error", common.RIP)
+	}
+}
+
+func TestWriteReg(t *testing.T) {
+	tests := []struct {
+		reg  common.Reg
+		val  uint64
+		want uint64 // RAX afterwards, R8 for R8B to R8
+	}{
+		{common.AL, 0xff, 0x11223344556677ff},
+		{common.AH, 0xff, 0x112233445566ff88},
+		{common.AX, 0xabcd, 0x112233445566abcd},
+		{common.EAX, 0xabcd, 0xabcd}, // Zero-extended
+		{common.RAX, 0xdeadbeefdeadbeef, 0xdeadbeefdeadbeef},
+		{common.AL, 0x1ff, 0x11223344556677ff}, // Truncated
+		{common.R8B, 0x01, 0xffffffffffffff01},
+		{common.R8W, 0x0102, 0xffffffffffff0102},
+		{common.R8L, 0x01020304, 0x01020304},
+	}
+	for _, test := range tests {
+		regs := testRegs()
+		if err := writeReg(test.reg, test.val, regs); err != nil {
+			t.Errorf("%v: %v", test.reg, err)
+			continue
+		}
+		got := regs.Rax
+		switch test.reg {
+		case common.R8B, common.R8W, common.R8L, common.R8:
+			got = regs.R8
+		}
+		if got != test.want {
+			t.Errorf("%v = %#x: got %#x, want %#x", test.reg, test.val, got, test.want)
+		}
+		if regs.Rbx != testRegs().Rbx || regs.Rcx != testRegs().Rcx {
+			t.Errorf("%v = %#x: other registers changed", test.reg, test.val)
+		}
+	}
+}
+
+func TestAssemble(t *testing.T) {
+	rel := func(imm int64) [2]common.Operand { return [2]common.Operand{{Kind: common.OperandRel, Imm: imm}} }
+	tests := []struct {
+		name string
+		sem  common.Semantics
+		want []byte // nil if the instruction can't be restored
+	}{
+		{"jmp rel8", common.Semantics{Kind: common.KindJump, Len: 2, AddrSize: 64, Args: rel(-2)}, []byte{0xEB, 0xFE}},
+		{"jmp rel32", common.Semantics{Kind: common.KindJump, Len: 5, AddrSize: 64, Args: rel(0x1000)},
+			[]byte{0xE9, 0x00, 0x10, 0x00, 0x00}},
+		{"jmp padded", common.Semantics{Kind: common.KindJump, Len: 5, AddrSize: 64, Args: rel(0x10)},
+			[]byte{0x3E, 0x3E, 0x3E, 0xEB, 0x10}},
+		{"jne rel8", common.Semantics{Kind: common.KindJump, Cond: common.CondNE, Len: 2, AddrSize: 64, Args: rel(0x7f)},
+			[]byte{0x75, 0x7F}},
+		{"jg rel32", common.Semantics{Kind: common.KindJump, Cond: common.CondG, Len: 6, AddrSize: 64, Args: rel(-0x80000000)},
+			[]byte{0x0F, 0x8F, 0x00, 0x00, 0x00, 0x80}},
+		{"jrcxz", common.Semantics{Kind: common.KindJump, Cond: common.CondCXZ, Len: 2, AddrSize: 64, Args: rel(4)},
+			[]byte{0xE3, 0x04}},
+		{"jecxz", common.Semantics{Kind: common.KindJump, Cond: common.CondCXZ, Len: 3, AddrSize: 32, Args: rel(4)},
+			[]byte{0x67, 0xE3, 0x04}},
+		{"jrcxz rel32", common.Semantics{Kind: common.KindJump, Cond: common.CondCXZ, Len: 6, AddrSize: 64, Args: rel(0x100)}, nil},
+		{"call", common.Semantics{Kind: common.KindCall, Len: 5, AddrSize: 64, Args: rel(-5)},
+			[]byte{0xE8, 0xFB, 0xFF, 0xFF, 0xFF}},
+		{"ret", common.Semantics{Kind: common.KindRet, Len: 1, AddrSize: 64}, []byte{0xC3}},
+		{"ret imm", common.Semantics{Kind: common.KindRet, Len: 3, AddrSize: 64,
+			Args: [2]common.Operand{{Kind: common.OperandImm, Imm: 0x10}}}, []byte{0xC2, 0x10, 0x00}},
+		{"loop", common.Semantics{Kind: common.KindLoop, Len: 2, AddrSize: 64, Args: rel(-4)}, []byte{0xE2, 0xFC}},
+		{"loope 32 bit", common.Semantics{Kind: common.KindLoop, Cond: common.CondE, Len: 3, AddrSize: 32, Args: rel(-4)},
+			[]byte{0x67, 0xE1, 0xFC}},
+		{"too long", common.Semantics{Kind: common.KindJump, Len: 2, AddrSize: 64, Args: rel(0x100)}, nil},
+		{"indirect jump", common.Semantics{Kind: common.KindJump, Len: 2, AddrSize: 64,
+			Args: [2]common.Operand{{Kind: common.OperandReg, Reg: common.RAX}}}, nil},
+		{"cmov", common.Semantics{Kind: common.KindMove, Cond: common.CondE, Len: 4, AddrSize: 64,
+			Args: [2]common.Operand{{Kind: common.OperandReg, Reg: common.RAX}, {Kind: common.OperandReg, Reg: common.RBX}}}, nil},
+	}
+	for _, test := range tests {
+		got, ok := assemble(test.sem)
+		if ok != (test.want != nil) || !bytes.Equal(got, test.want) {
+			t.Errorf("%s: assembled as % x, %v, want % x", test.name, got, ok, test.want)
+		}
+	}
+
+	// Calls and returns are checked by the shadow stack
+	shadowStack = true
+	defer func() { shadowStack = false }()
+	for _, test := range tests[8:11] {
+		if got, ok := assemble(test.sem); ok {
+			t.Errorf("%s: assembled as % x with shadow stack", test.name, got)
+		}
+	}
+}
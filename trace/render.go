@@ -0,0 +1,82 @@
+package trace
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Timeline writes one line per event in the order the events were recorded
+// At most limit events are written, all if limit is 0.
+func Timeline(w io.Writer, t *Trace, limit int) {
+	_, _ = fmt.Fprintf(w, "Trace started at %v with %d events\n", t.Start.Format("2006-01-02 15:04:05.000000"), len(t.Events))
+	for i, e := range t.Events {
+		if limit > 0 && i == limit {
+			_, _ = fmt.Fprintf(w, "... %d more events\n", len(t.Events)-limit)
+			break
+		}
+		taken := "not taken"
+		if e.Taken {
+			taken = "taken"
+		}
+		_, _ = fmt.Fprintf(w, "%12.6fs  tid %-7d %s:0x%-8x %-4v %-9s -> 0x%x\n",
+			e.Time.Seconds(), e.Tid, e.Module, e.Addr, e.Kind, taken, e.Target)
+	}
+}
+
+// Histogram writes the number of hits per obfuscated instruction, the hottest first
+// At most limit instructions are written, all if limit is 0.
+func Histogram(w io.Writer, t *Trace, limit int) {
+	type site struct {
+		module string
+		addr   uint64
+	}
+	type count struct {
+		site
+		event Event
+		hits  int
+		taken int
+	}
+	counts := make(map[site]*count)
+	for _, e := range t.Events {
+		s := site{e.Module, e.Addr}
+		c, exists := counts[s]
+		if !exists {
+			c = &count{site: s, event: e}
+			counts[s] = c
+		}
+		c.hits++
+		if e.Taken {
+			c.taken++
+		}
+	}
+
+	sorted := make([]*count, 0, len(counts))
+	for _, c := range counts {
+		sorted = append(sorted, c)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].hits != sorted[j].hits {
+			return sorted[i].hits > sorted[j].hits
+		}
+		if sorted[i].module != sorted[j].module {
+			return sorted[i].module < sorted[j].module
+		}
+		return sorted[i].addr < sorted[j].addr
+	})
+	if limit > 0 && len(sorted) > limit {
+		sorted = sorted[:limit]
+	}
+
+	const width = 40
+	_, _ = fmt.Fprintf(w, "%d events at %d obfuscated instructions\n", len(t.Events), len(counts))
+	for _, c := range sorted {
+		bar := c.hits * width / sorted[0].hits
+		if bar == 0 {
+			bar = 1
+		}
+		_, _ = fmt.Fprintf(w, "%s:0x%-8x %-4v %10d hits %10d taken  %s\n",
+			c.module, c.addr, c.event.Kind, c.hits, c.taken, strings.Repeat("#", bar))
+	}
+}
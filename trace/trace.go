@@ -0,0 +1,167 @@
+package trace
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/BlobbyBob/PtraceObfuscator/common"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// Binary trace format
+//
+// The runtime records every handled breakpoint into a trace file:
+//
+//	header: magic "PTOT" | version (1 byte) | start time (8 bytes) | module count (2 bytes) | module names
+//	name:   length (2 bytes) | name
+//	event:  time (8 bytes) | tid (4 bytes) | module (2 bytes) | kind (1 byte) | taken (1 byte) | addr (8 bytes) | target (8 bytes)
+//
+// All numbers are little endian. The start time is given in nanoseconds since the Unix epoch, the time of an
+// event in nanoseconds since the start. The events have a fixed size, so the runtime can write them cheaply.
+const (
+	traceVersion = 1
+	eventSize    = 32
+)
+
+var traceMagic = []byte("PTOT")
+
+// ErrInvalidTrace is returned, if a trace file is malformed
+var ErrInvalidTrace = errors.New("invalid trace")
+
+// Event is a breakpoint handled by the runtime
+type Event struct {
+	Time   time.Duration // Since the start of the trace
+	Tid    int
+	Module string
+	Addr   uint64 // Address of the obfuscated instruction in the ELF file
+	Kind   common.Kind
+	Taken  bool   // Whether the jump, call or loop was taken or the move or set performed
+	Target uint64 // Instruction pointer after performing the instruction
+}
+
+// Trace is the content of a trace file
+type Trace struct {
+	Start   time.Time
+	Modules []string
+	Events  []Event
+}
+
+// Writer records events into a trace file
+type Writer struct {
+	file    *os.File
+	buf     *bufio.Writer
+	start   time.Time
+	modules map[string]uint16
+	event   [eventSize]byte
+}
+
+// Create a trace file for the given modules
+func Create(file string, modules []string) (*Writer, error) {
+	f, err := os.Create(file)
+	if err != nil {
+		return nil, err
+	}
+	w := &Writer{file: f, buf: bufio.NewWriterSize(f, 1<<16), start: time.Now(), modules: make(map[string]uint16)}
+
+	var header bytes.Buffer
+	header.Write(traceMagic)
+	header.WriteByte(traceVersion)
+	_ = binary.Write(&header, binary.LittleEndian, w.start.UnixNano())
+	_ = binary.Write(&header, binary.LittleEndian, uint16(len(modules)))
+	for i, name := range modules {
+		w.modules[name] = uint16(i)
+		_ = binary.Write(&header, binary.LittleEndian, uint16(len(name)))
+		header.WriteString(name)
+	}
+	if _, err := w.buf.Write(header.Bytes()); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// Record an event, its time is set to the current time
+func (w *Writer) Record(e Event) error {
+	module, exists := w.modules[e.Module]
+	if !exists {
+		return fmt.Errorf("unknown module %v", e.Module)
+	}
+	b := w.event[:]
+	binary.LittleEndian.PutUint64(b[0:], uint64(time.Since(w.start)))
+	binary.LittleEndian.PutUint32(b[8:], uint32(e.Tid))
+	binary.LittleEndian.PutUint16(b[12:], module)
+	b[14] = byte(e.Kind)
+	b[15] = 0
+	if e.Taken {
+		b[15] = 1
+	}
+	binary.LittleEndian.PutUint64(b[16:], e.Addr)
+	binary.LittleEndian.PutUint64(b[24:], e.Target)
+	_, err := w.buf.Write(b)
+	return err
+}
+
+// Close flushes the recorded events and closes the file
+func (w *Writer) Close() error {
+	err := w.buf.Flush()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Read a trace file
+// A truncated last event, e.g. if the runtime was killed, is ignored.
+func Read(file string) (*Trace, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	r := bytes.NewReader(data)
+	header := make([]byte, len(traceMagic)+1)
+	if _, err := r.Read(header); err != nil || !bytes.Equal(header[:len(traceMagic)], traceMagic) {
+		return nil, ErrInvalidTrace
+	}
+	if version := header[len(traceMagic)]; version != traceVersion {
+		return nil, fmt.Errorf("unsupported trace version %d", version)
+	}
+
+	var start int64
+	var count uint16
+	if binary.Read(r, binary.LittleEndian, &start) != nil || binary.Read(r, binary.LittleEndian, &count) != nil {
+		return nil, ErrInvalidTrace
+	}
+	t := &Trace{Start: time.Unix(0, start), Modules: make([]string, count)}
+	for i := range t.Modules {
+		var length uint16
+		if binary.Read(r, binary.LittleEndian, &length) != nil || int(length) > r.Len() {
+			return nil, ErrInvalidTrace
+		}
+		name := make([]byte, length)
+		_, _ = r.Read(name)
+		t.Modules[i] = string(name)
+	}
+
+	events := data[len(data)-r.Len():]
+	t.Events = make([]Event, 0, len(events)/eventSize)
+	for ; len(events) >= eventSize; events = events[eventSize:] {
+		module := binary.LittleEndian.Uint16(events[12:])
+		if int(module) >= len(t.Modules) {
+			return nil, ErrInvalidTrace
+		}
+		t.Events = append(t.Events, Event{
+			Time:   time.Duration(binary.LittleEndian.Uint64(events[0:])),
+			Tid:    int(binary.LittleEndian.Uint32(events[8:])),
+			Module: t.Modules[module],
+			Kind:   common.Kind(events[14]),
+			Taken:  events[15] != 0,
+			Addr:   binary.LittleEndian.Uint64(events[16:]),
+			Target: binary.LittleEndian.Uint64(events[24:]),
+		})
+	}
+	return t, nil
+}
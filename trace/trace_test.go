@@ -0,0 +1,105 @@
+package trace
+
+import (
+	"github.com/BlobbyBob/PtraceObfuscator/common"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var testEvents = []Event{
+	{Tid: 100, Module: "binary", Addr: 0x1010, Kind: common.KindCall, Taken: true, Target: 0x7f0000001000},
+	{Tid: 101, Module: "libfoo.so.1", Addr: 0x520, Kind: common.KindJump, Taken: false, Target: 0x7f0000000522},
+	{Tid: 100, Module: "binary", Addr: 0x1ff0, Kind: common.KindRet, Taken: true, Target: 0x555555555015},
+}
+
+func writeTrace(t *testing.T) string {
+	file := filepath.Join(t.TempDir(), "test.trace")
+	w, err := Create(file, []string{"binary", "libfoo.so.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range testEvents {
+		if err := w.Record(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Record(Event{Module: "unknown"}); err == nil {
+		t.Error("recorded event of unknown module")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestRoundTrip(t *testing.T) {
+	tr, err := Read(writeTrace(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tr.Modules, []string{"binary", "libfoo.so.1"}) {
+		t.Errorf("modules %v", tr.Modules)
+	}
+
+	// The time is set when recording
+	got := make([]Event, len(tr.Events))
+	for i, e := range tr.Events {
+		if i > 0 && e.Time < tr.Events[i-1].Time {
+			t.Errorf("event %d recorded before event %d", i, i-1)
+		}
+		e.Time = 0
+		got[i] = e
+	}
+	if !reflect.DeepEqual(got, testEvents) {
+		t.Errorf("events %+v, want %+v", got, testEvents)
+	}
+}
+
+func TestReadTruncated(t *testing.T) {
+	file := writeTrace(t)
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(file, info.Size()-1); err != nil {
+		t.Fatal(err)
+	}
+	tr, err := Read(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.Events) != len(testEvents)-1 {
+		t.Errorf("read %d events, want %d", len(tr.Events), len(testEvents)-1)
+	}
+}
+
+func TestReadInvalid(t *testing.T) {
+	valid, err := ioutil.ReadFile(writeTrace(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	modify := func(i int, b byte) []byte {
+		data := append([]byte(nil), valid...)
+		data[i] = b
+		return data
+	}
+	tests := map[string][]byte{
+		"empty":        {},
+		"magic":        modify(0, 'X'),
+		"version":      modify(len(traceMagic), traceVersion+1),
+		"module count": modify(len(traceMagic)+9, 0xff),
+		"module":       modify(len(valid)-eventSize+12, 2),
+	}
+	for name, data := range tests {
+		file := filepath.Join(t.TempDir(), "invalid.trace")
+		if err := ioutil.WriteFile(file, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if tr, err := Read(file); err == nil {
+			t.Errorf("%s: read %+v", name, tr)
+		}
+	}
+}